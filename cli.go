@@ -6,7 +6,9 @@ import (
 	"lieu/crawler"
 	"lieu/database"
 	"lieu/ingest"
+	"lieu/linkrot"
 	"lieu/server"
+	"lieu/types"
 	"lieu/util"
 	"os"
 	"strings"
@@ -17,8 +19,10 @@ const help = `Lieu: neighbourhood search engine
 Commands
 - precrawl  (scrapes config's general.url for a list of links: <li> elements containing an anchor <a> tag)
 - crawl     (start crawler, crawls all urls in config's crawler.webring file. outputs to stdout)
-- ingest    (ingest crawled data, generates database)
+- ingest    (ingest crawled data, generates database. given warc files, ingests the crawl archived in them)
 - search    (interactive cli for searching the database)
+- synonyms check (reports which terms of config's data.synonyms file exist in the database)
+- linkrot   (checks the links found while crawling for rot, and reports the broken ones per site)
 - host      (hosts search engine over http) 
 
 Example:
@@ -72,6 +76,18 @@ func main() {
 		}
 		crawler.Crawl(config)
 	case "ingest":
+		// lieu ingest <file.warc.gz>... replays an archived crawl instead of reading the crawler's output
+		if len(os.Args) > 2 {
+			for _, path := range os.Args[2:] {
+				if !util.CheckFileExists(path) {
+					fmt.Printf("lieu: warc file %s does not exist\n", path)
+					util.Exit()
+				}
+			}
+			fmt.Println("lieu: creating a new database & initiating ingestion from warc")
+			ingest.IngestWARC(config, os.Args[2:])
+			break
+		}
 		exists := util.CheckFileExists(config.Data.Source)
 		if !exists {
 			fmt.Printf("lieu: data source %s does not exist\n", config.Data.Source)
@@ -91,7 +107,23 @@ func main() {
 		if !exists {
 			util.DatabaseDoesNotExist(config.Data.Database)
 		}
-		interactiveMode(config.Data.Database)
+		interactiveMode(config)
+	case "synonyms":
+		if len(os.Args) < 3 || os.Args[2] != "check" {
+			fmt.Println("lieu: usage `lieu synonyms check`")
+			util.Exit()
+		}
+		exists := util.CheckFileExists(config.Data.Database)
+		if !exists {
+			util.DatabaseDoesNotExist(config.Data.Database)
+		}
+		checkSynonyms(config)
+	case "linkrot":
+		exists := util.CheckFileExists(config.Data.Database)
+		if !exists {
+			util.DatabaseDoesNotExist(config.Data.Database)
+		}
+		linkrot.Check(config)
 	case "random":
 		exists := util.CheckFileExists(config.Data.Database)
 		if !exists {
@@ -115,15 +147,22 @@ func main() {
 	}
 }
 
-func interactiveMode(databasePath string) {
-	db := database.InitDB(databasePath)
+func interactiveMode(config types.Config) {
+	db := database.InitDB(config.Data.Database)
+	synonyms := util.ReadSynonyms(config.Data.Synonyms, config.Data.FoldDiacritics)
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Printf("> ")
 		input, err := reader.ReadString('\n')
 		util.Check(err)
 		input = strings.TrimSuffix(input, "\n")
-		pages := database.SearchWordsByScore(db, util.Inflect(strings.Fields(input)))
+		terms, foldable := util.QueryTerms(strings.Fields(input), config.Data.FoldDiacritics)
+		related := util.ExpandSynonyms(terms, synonyms)
+		if config.Data.FoldDiacritics {
+			related = database.UnfoldTerms(db, related, related)
+		}
+		query := types.SearchQuery{Words: database.UnfoldTerms(db, terms, foldable), Synonyms: related}
+		pages := database.SearchWords(db, query, true, config.Ranking)
 		for _, pageData := range pages {
 			fmt.Println(pageData.URL)
 			if len(pageData.About) > 0 {
@@ -132,3 +171,35 @@ func interactiveMode(databasePath string) {
 		}
 	}
 }
+
+func checkSynonyms(config types.Config) {
+	groups := util.ReadSynonymGroups(config.Data.Synonyms)
+	if len(groups) == 0 {
+		fmt.Printf("lieu: no synonyms found in %s\n", config.Data.Synonyms)
+		return
+	}
+	db := database.InitDB(config.Data.Database)
+	var missing int
+	for _, group := range groups {
+		fmt.Println(strings.Join(group, ", "))
+		for _, entry := range group {
+			terms, _ := util.QueryTerms(strings.Fields(entry), false)
+			counts := make([]string, 0, len(terms))
+			found := len(terms) > 0
+			for _, term := range terms {
+				count := database.GetTermPageCount(db, term)
+				if count == 0 {
+					found = false
+				}
+				counts = append(counts, fmt.Sprintf("%s: %d pages", term, count))
+			}
+			status := "ok"
+			if !found {
+				status = "missing"
+				missing++
+			}
+			fmt.Printf("  %-8s%s (%s)\n", status, entry, strings.Join(counts, ", "))
+		}
+	}
+	fmt.Printf("lieu: %d synonyms in %d groups do not exist in the index\n", missing, len(groups))
+}
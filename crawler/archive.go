@@ -0,0 +1,50 @@
+package crawler
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ArchivePath returns where the snapshot with the given content hash is stored within the archive directory.
+// snapshots are spread over subdirectories named after the first two characters of their hash
+func ArchivePath(dir, hash string) string {
+	return filepath.Join(dir, hash[:2], hash+".html.gz")
+}
+
+// archivePage stores a compressed copy of a fetched page, unless a page with the same contents was stored before,
+// and returns the hash of its contents
+func archivePage(dir string, body []byte) (string, error) {
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	path := ArchivePath(dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first, so that an interrupted crawl leaves no partial snapshots behind
+	tmp, err := ioutil.TempFile(filepath.Dir(path), hash+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	if _, err = zw.Write(body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = zw.Close(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), path)
+}
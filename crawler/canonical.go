@@ -0,0 +1,26 @@
+package crawler
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// canonicalLink returns the address of the page's <link rel="canonical">, if it has one
+func canonicalLink(body []byte) string {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	href, _ := doc.Find(`head link[rel~="canonical"]`).First().Attr("href")
+	return strings.TrimSpace(href)
+}
+
+// sameHost reports whether both urls are on the same host
+func sameHost(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	return errA == nil && errB == nil && ua.Host == ub.Host
+}
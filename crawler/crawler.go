@@ -3,24 +3,39 @@ package crawler
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"lieu/types"
+	"lieu/urlnorm"
 	"lieu/util"
+	"lieu/warc"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gocolly/colly/v2"
 	"github.com/gocolly/colly/v2/queue"
 )
 
-// WebringLink represents a link from the webring with its precrawl depth
+// where the crawled data is written to, one item per line
+var output io.Writer = os.Stdout
+
+// WebringLink represents a link from the webring with its precrawl depth, and the rules for crawling its site
 type WebringLink struct {
 	URL   string
 	Depth int
+	// path globs of the pages to crawl, and of those not to crawl
+	Include []string
+	Exclude []string
+	// the most pages to crawl, and how many links away from the start page to go; 0 means no limit
+	MaxPages int
+	MaxDepth int
+	Tags     []string
 }
 
 // the following domains are excluded from crawling & indexing, typically because they have a lot of microblog pages
@@ -45,6 +60,11 @@ func getAboutHeuristics(path string) []string {
 	return util.ReadList(path, "\n")
 }
 
+// the query parameters which identify a page, e.g. page for paginated archives; all others are removed from urls
+func getQueryParameters(path string) []string {
+	return util.ReadList(path, "\n")
+}
+
 func getPreviewQueries(path string) []string {
 	previewQueries := util.ReadList(path, "\n")
 	if len(previewQueries) > 0 {
@@ -76,13 +96,14 @@ func getLink(target string) string {
 	return strings.TrimSuffix(target, "/")
 }
 
-func getWebringLinks(path string) []WebringLink {
+// ReadWebring reads the members of the webring from the webring file
+func ReadWebring(path string) []WebringLink {
 	var links []WebringLink
 	candidates := util.ReadList(path, "\n")
 	for _, l := range candidates {
-		// Parse the format "URL | depth"
+		// Parse the format "URL | depth", optionally followed by "| key=value ..." options
 		parts := strings.Split(l, " | ")
-		if len(parts) != 2 {
+		if len(parts) < 2 || len(parts) > 3 {
 			continue
 		}
 		
@@ -102,31 +123,30 @@ func getWebringLinks(path string) []WebringLink {
 			depth = d
 		}
 		
-		links = append(links, WebringLink{
+		link := WebringLink{
 			URL:   u.String(),
 			Depth: depth,
-		})
+		}
+		if len(parts) == 3 {
+			parseSiteOptions(parts[2], &link)
+		}
+		links = append(links, link)
 	}
 	return links
 }
 
-func getDomains(links []WebringLink) ([]string, []string) {
+// getDomains returns the hosts of the webring's members. which pages of a host belong to which member is up to the
+// crawler's scope: a member pointing to a path, e.g. https://example.com/site/lupin, only has the pages below it
+func getDomains(links []WebringLink) []string {
 	var domains []string
-	// sites which should have stricter crawling enforced (e.g. applicable for shared sites like tilde sites)
-	// pathsites are sites that are passed in which contain path,
-	// e.g. https://example.com/site/lupin -> only children pages of /site/lupin/ will be crawled
-	var pathsites []string
 	for _, link := range links {
 		u, err := url.Parse(link.URL)
 		if err != nil {
 			continue
 		}
 		domains = append(domains, u.Hostname())
-		if len(u.Path) > 0 && (u.Path != "/" || u.Path != "index.html") {
-			pathsites = append(pathsites, link.URL)
-		}
 	}
-	return domains, pathsites
+	return domains
 }
 
 func findSuffix(suffixes []string, query string) bool {
@@ -146,48 +166,99 @@ func cleanText(s string) string {
 	return s
 }
 
+// the longest anchor text kept for a link, in characters
+const maxAnchorLength = 200
+
+// anchorText returns the text describing a link: its contents, or the title or image alt text if it has no text
+func anchorText(e *colly.HTMLElement) string {
+	text := strings.Join(strings.Fields(e.Text), " ")
+	if text == "" {
+		text = strings.Join(strings.Fields(e.Attr("title")), " ")
+	}
+	if text == "" {
+		text = strings.Join(strings.Fields(e.ChildAttr("img", "alt")), " ")
+	}
+	if runes := []rune(text); len(runes) > maxAnchorLength {
+		text = string(runes[:maxAnchorLength])
+	}
+	return text
+}
+
 func handleIndexing(c *colly.Collector, previewQueries []string, heuristics []string, precrawlDepths map[string]int) {
-	c.OnHTML("meta[name=\"keywords\"]", func(e *colly.HTMLElement) {
+	// a page naming another address as its canonical one leaves its contents to be indexed at that address
+	onPage := func(selector string, f colly.HTMLCallback) {
+		c.OnHTML(selector, func(e *colly.HTMLElement) {
+			if e.Request.Ctx.Get("canonical") == "" {
+				f(e)
+			}
+		})
+	}
+
+	onPage("meta[name=\"keywords\"]", func(e *colly.HTMLElement) {
 		domain := e.Request.URL.Hostname()
 		depth := precrawlDepths[domain]
-		fmt.Println("keywords", cleanText(e.Attr("content")), e.Request.URL, depth)
+		fmt.Fprintln(output, "keywords", cleanText(e.Attr("content")), e.Request.URL, depth)
 	})
 
-	c.OnHTML("meta[name=\"description\"]", func(e *colly.HTMLElement) {
+	onPage("meta[name=\"description\"]", func(e *colly.HTMLElement) {
 		desc := cleanText(e.Attr("content"))
 		if len(desc) > 0 && len(desc) < 1500 {
 			domain := e.Request.URL.Hostname()
 			depth := precrawlDepths[domain]
-			fmt.Println("desc", desc, e.Request.URL, depth)
+			fmt.Fprintln(output, "desc", desc, e.Request.URL, depth)
 		}
 	})
 
-	c.OnHTML("meta[property=\"og:description\"]", func(e *colly.HTMLElement) {
+	onPage("meta[property=\"og:description\"]", func(e *colly.HTMLElement) {
 		ogDesc := cleanText(e.Attr("content"))
 		if len(ogDesc) > 0 && len(ogDesc) < 1500 {
 			domain := e.Request.URL.Hostname()
 			depth := precrawlDepths[domain]
-			fmt.Println("og-desc", ogDesc, e.Request.URL, depth)
+			fmt.Fprintln(output, "og-desc", ogDesc, e.Request.URL, depth)
 		}
 	})
 
-	c.OnHTML("html[lang]", func(e *colly.HTMLElement) {
+	onPage("html[lang]", func(e *colly.HTMLElement) {
 		lang := cleanText(e.Attr("lang"))
 		if len(lang) > 0 && len(lang) < 100 {
 			domain := e.Request.URL.Hostname()
 			depth := precrawlDepths[domain]
-			fmt.Println("lang", lang, e.Request.URL, depth)
+			fmt.Fprintln(output, "lang", lang, e.Request.URL, depth)
+		}
+	})
+
+	// when the page was last modified, as reported by the server & by article metadata
+	c.OnResponse(func(r *colly.Response) {
+		if !strings.HasPrefix(r.Headers.Get("Content-Type"), "text/html") || r.Ctx.Get("canonical") != "" {
+			return
+		}
+		if modified, err := http.ParseTime(r.Headers.Get("Last-Modified")); err == nil {
+			depth := precrawlDepths[r.Request.URL.Hostname()]
+			fmt.Fprintln(output, "modified", modified.Format("2006-01-02"), r.Request.URL, depth)
+		}
+	})
+
+	onPage("meta[property=\"article:modified_time\"], meta[property=\"article:published_time\"]", func(e *colly.HTMLElement) {
+		// only the date part of the iso 8601 timestamp is of interest
+		content := strings.TrimSpace(e.Attr("content"))
+		if len(content) > 10 {
+			content = content[:10]
+		}
+		if modified, err := time.Parse("2006-01-02", content); err == nil {
+			domain := e.Request.URL.Hostname()
+			depth := precrawlDepths[domain]
+			fmt.Fprintln(output, "modified", modified.Format("2006-01-02"), e.Request.URL, depth)
 		}
 	})
 
 	// get page title
-	c.OnHTML("title", func(e *colly.HTMLElement) {
+	onPage("title", func(e *colly.HTMLElement) {
 		domain := e.Request.URL.Hostname()
 		depth := precrawlDepths[domain]
-		fmt.Println("title", cleanText(e.Text), e.Request.URL, depth)
+		fmt.Fprintln(output, "title", cleanText(e.Text), e.Request.URL, depth)
 	})
 
-	c.OnHTML("body", func(e *colly.HTMLElement) {
+	onPage("body", func(e *colly.HTMLElement) {
 		domain := e.Request.URL.Hostname()
 		depth := precrawlDepths[domain]
 	QueryLoop:
@@ -199,7 +270,7 @@ func handleIndexing(c *colly.Collector, previewQueries []string, heuristics []st
 				paragraph := cleanText(element_text)
 				if len(paragraph) < 1500 && len(paragraph) > 20 {
 					if !util.Contains(heuristics, strings.ToLower(paragraph)) {
-						fmt.Println("para", paragraph, e.Request.URL, depth)
+						fmt.Fprintln(output, "para", paragraph, e.Request.URL, depth)
 						break QueryLoop
 					}
 				}
@@ -207,7 +278,7 @@ func handleIndexing(c *colly.Collector, previewQueries []string, heuristics []st
 		}
 		paragraph := cleanText(e.DOM.Find("p").First().Text())
 		if len(paragraph) < 1500 && len(paragraph) > 0 {
-			fmt.Println("para-just-p", paragraph, e.Request.URL, depth)
+			fmt.Fprintln(output, "para-just-p", paragraph, e.Request.URL, depth)
 		}
 
 		// get all relevant page headings
@@ -220,7 +291,7 @@ func handleIndexing(c *colly.Collector, previewQueries []string, heuristics []st
 func collectHeadingText(heading string, e *colly.HTMLElement, depth int) {
 	for _, headingText := range e.ChildTexts(heading) {
 		if len(headingText) < 500 {
-			fmt.Println(heading, cleanText(headingText), e.Request.URL, depth)
+			fmt.Fprintln(output, heading, cleanText(headingText), e.Request.URL, depth)
 		}
 	}
 }
@@ -390,10 +461,43 @@ func Crawl(config types.Config) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	crawl(config, nil)
+}
+
+// Replay crawls the webring as captured in the given WARC files, instead of over the network, writing the crawled
+// data to out. pages are extracted exactly as in a regular crawl, which makes it possible to re-index an earlier crawl
+// with newer extraction rules, or to index an archive made by another tool
+func Replay(config types.Config, paths []string, out io.Writer) error {
+	index, err := warc.NewIndex(paths)
+	if err != nil {
+		return err
+	}
+	output = out
+	defer func() { output = os.Stdout }()
+	crawl(config, index)
+	return nil
+}
+
+// NewNormalizer returns the url normalizer for the webring, used to address each page the same way when crawling as
+// when ingesting
+func NewNormalizer(config types.Config) *urlnorm.Normalizer {
+	links := ReadWebring(config.Crawler.Webring)
+	members := make([]string, 0, len(links))
+	for _, link := range links {
+		members = append(members, link.URL)
+	}
+	return urlnorm.New(members, getQueryParameters(config.Crawler.QueryParameters))
+}
+
+// crawl visits the webring, over the network or, if index is set, by replaying the responses stored in an archive
+func crawl(config types.Config, index *warc.Index) {
 	SUFFIXES := getBannedSuffixes(config.Crawler.BannedSuffixes)
-	links := getWebringLinks(config.Crawler.Webring)
-	domains, pathsites := getDomains(links)
+	links := ReadWebring(config.Crawler.Webring)
+	domains := getDomains(links)
 	initialDomain := config.General.URL
+	normalizer := NewNormalizer(config)
+	sites := newScope(links, normalizer)
+	traps := newTrapDetector(config.Crawler.MaxURLLength, config.Crawler.MaxFanout)
 
 	// Create a map to store precrawl depths for each domain
 	precrawlDepths := make(map[string]int)
@@ -410,7 +514,9 @@ func Crawl(config types.Config) {
 	c := colly.NewCollector(
 		colly.MaxDepth(3),
 	)
-	if config.General.Proxy != "" {
+	if index != nil {
+		c.WithTransport(&replayTransport{index: index})
+	} else if config.General.Proxy != "" {
 		c.SetProxy(config.General.Proxy)
 	}
 
@@ -420,7 +526,17 @@ func Crawl(config types.Config) {
 	)
 
 	for _, link := range links {
-		q.AddURL(link.URL)
+		if start, ok := normalizer.Normalize(link.URL); ok {
+			enqueue(q, start, 0)
+		}
+	}
+	// an archive may hold pages which can't be reached by following links from the start pages
+	if index != nil {
+		for _, link := range index.URLs() {
+			if link, ok := normalizer.Normalize(link); ok && sites.allows(link) {
+				enqueue(q, link, 0)
+			}
+		}
 	}
 
 	c.UserAgent = "MoldWeb_crawler"
@@ -428,7 +544,11 @@ func Crawl(config types.Config) {
 	c.AllowURLRevisit = false
 	c.DisallowedDomains = getBannedDomains(config.Crawler.BannedDomains)
 
+	// replaying an archive puts no load on anyone's server
 	delay, _ := time.ParseDuration("200ms")
+	if index != nil {
+		delay = 0
+	}
 	c.Limit(&colly.LimitRule{DomainGlob: "*", Delay: delay, Parallelism: 3})
 
 	boringDomains := getBoringDomains(config.Crawler.BoringDomains)
@@ -436,6 +556,10 @@ func Crawl(config types.Config) {
 	previewQueries := getPreviewQueries(config.Crawler.PreviewQueries)
 	heuristics := getAboutHeuristics(config.Data.Heuristics)
 
+	// the pages outside of the webring which were linked to, visited after the crawl if fetchOutgoing is set
+	outgoing := make(map[string]bool)
+	var outgoingMutex sync.Mutex
+
 	// on every a element which has an href attribute, call callback
 	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
 
@@ -443,56 +567,197 @@ func Crawl(config types.Config) {
 			return
 		}
 
-		link := getLink(e.Attr("href"))
-		if findSuffix(SUFFIXES, link) {
+		link, ok := normalizer.Normalize(e.Request.AbsoluteURL(e.Attr("href")))
+		if !ok {
 			return
 		}
-
-		link = e.Request.AbsoluteURL(link)
 		u, err := url.Parse(link)
-		if err != nil {
+		if err != nil || findSuffix(SUFFIXES, u.Path) {
 			return
 		}
 
 		outgoingDomain := u.Hostname()
 		currentDomain := e.Request.URL.Hostname()
 
-		// log which site links to what
-		if !util.Contains(boringWords, link) && !util.Contains(boringDomains, link) {
+		// log which site links to what. a page deferring to its canonical address links from there instead
+		if e.Request.Ctx.Get("canonical") == "" && !util.Contains(boringWords, link) && !util.Contains(boringDomains, link) {
 			currentDepth := precrawlDepths[currentDomain]
 			// log precrawl depths
 			// fmt.Println("currentDepth", currentDomain, outgoingDomain, currentDepth)
 			if !find(domains, outgoingDomain) {
-				fmt.Println("non-webring-link", link, e.Request.URL, currentDepth)
+				fmt.Fprintln(output, "non-webring-link", link, anchorText(e), e.Request.URL, currentDepth)
+				if config.Crawler.FetchOutgoing {
+					outgoingMutex.Lock()
+					outgoing[link] = true
+					outgoingMutex.Unlock()
+				}
 				// solidarity! someone in the webring linked to someone else in it
 			} else if outgoingDomain != currentDomain && outgoingDomain != initialDomain && currentDomain != initialDomain {
-				fmt.Println("webring-link", link, e.Request.URL, currentDepth)
+				// the link's text follows the link, describing the linked page in the words of the linking member
+				fmt.Fprintln(output, "webring-link", link, anchorText(e), e.Request.URL, currentDepth)
+				// kept for checking the links of a site for rot, rather than for describing the linked page
+			} else if outgoingDomain == currentDomain && currentDomain != initialDomain {
+				fmt.Fprintln(output, "internal-link", link, e.Request.URL, currentDepth)
 			}
 		}
 
-		// rule-based crawling
-		var pathsite string
-		for _, s := range pathsites {
-			if strings.Contains(s, outgoingDomain) {
-				pathsite = s
-				break
-			}
+		// rule-based crawling: only the pages of members, as limited by their entries in the webring file
+		if !sites.allows(link) || e.Request.Ctx.Get("trap") != "" {
+			return
 		}
-		// the visited site was a so called »pathsite», a site with restrictions on which pages can be crawled (most often due to
-		// existing on a shared domain)
-		if pathsite != "" {
-			// make sure we're only crawling descendents of the original path
-			if strings.HasPrefix(link, pathsite) {
-				q.AddURL(link)
-			}
-		} else {
-			// visits links from AllowedDomains
-			q.AddURL(link)
+		depth, _ := strconv.Atoi(e.Request.Ctx.Get("depth"))
+		if depth, ok := sites.withinDepth(e.Request.URL, u, depth); ok && traps.allows(link, u) {
+			enqueue(q, link, depth)
+		}
+	})
+
+	// members may limit the number of pages crawled on their site
+	c.OnRequest(func(r *colly.Request) {
+		if !sites.request(r.URL) {
+			traps.cutOff(r.URL, cutMaxPages)
+			r.Abort()
+		}
+	})
+
+	// keep every request & response, for replaying the crawl later on
+	var recorder *warcRecorder
+	if config.Crawler.WARC != "" && index == nil {
+		var err error
+		recorder, err = newWarcRecorder(config.Crawler.WARC)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		recorder.watch(c)
+		defer recorder.close()
+	}
+
+	// a page which names another address on the same site as its canonical one is indexed at that address instead
+	deferred := make(map[string]bool)
+	var deferredMutex sync.Mutex
+	c.OnResponse(func(r *colly.Response) {
+		if !strings.HasPrefix(r.Headers.Get("Content-Type"), "text/html") || r.StatusCode >= 300 {
+			return
+		}
+		href := canonicalLink(r.Body)
+		if href == "" {
+			return
+		}
+		canonical, ok := normalizer.Normalize(r.Request.AbsoluteURL(href))
+		current, _ := normalizer.Normalize(r.Request.URL.String())
+		if !ok || canonical == current || !sameHost(canonical, current) || !sites.allows(canonical) {
+			return
+		}
+		deferredMutex.Lock()
+		// pages naming each other as canonical: the one fetched last gets indexed
+		if deferred[canonical] {
+			deferredMutex.Unlock()
+			return
+		}
+		deferred[current] = true
+		deferredMutex.Unlock()
+		// nothing is indexed for this address, though its links are still followed
+		r.Ctx.Put("canonical", canonical)
+		depth, _ := strconv.Atoi(r.Ctx.Get("depth"))
+		enqueue(q, canonical, depth)
+	})
+
+	// the links of a page nearly the same as many others, like an empty day in a calendar, lead to more of the same
+	c.OnResponse(func(r *colly.Response) {
+		if !strings.HasPrefix(r.Headers.Get("Content-Type"), "text/html") || r.StatusCode >= 300 || r.Ctx.Get("canonical") != "" {
+			return
+		}
+		if traps.nearDuplicate(r.Request.URL, r.Body) {
+			r.Ctx.Put("trap", cutDuplicate)
 		}
 	})
 
 	handleIndexing(c, previewQueries, heuristics, precrawlDepths)
 
+	// keep a copy of every page, for when the original rots away
+	if config.Data.Archive != "" {
+		c.OnResponse(func(r *colly.Response) {
+			if !strings.HasPrefix(r.Headers.Get("Content-Type"), "text/html") || r.StatusCode >= 300 || r.Ctx.Get("canonical") != "" {
+				return
+			}
+			// a replayed page is archived as of when it was captured, not as of today
+			fetched := time.Now()
+			if index != nil {
+				var err error
+				fetched, err = time.Parse(time.RFC3339, r.Headers.Get(capturedHeader))
+				if err != nil {
+					log.Println("not archiving", r.Request.URL, "without a capture date")
+					return
+				}
+			}
+			hash, err := archivePage(config.Data.Archive, r.Body)
+			if err != nil {
+				log.Println("failed to archive", r.Request.URL, err)
+				return
+			}
+			depth := precrawlDepths[r.Request.URL.Hostname()]
+			fmt.Fprintln(output, "archived", hash, fetched.Format("2006-01-02"), r.Request.URL, depth)
+		})
+	}
+
+	// keep track of which sites could be reached. a replayed crawl says nothing about that
+	tracker := newStatusTracker()
+	if index == nil {
+		tracker.watch(c)
+	}
+
 	// start scraping
 	q.Run(c)
+	if index == nil {
+		tracker.printSiteStatus(links)
+		tracker.printCrawlStats(links, traps)
+	}
+	traps.logReport()
+
+	if config.Crawler.FetchOutgoing {
+		crawlOutgoing(c, outgoing, recorder)
+	}
+}
+
+// enqueue queues a link for crawling, along with its distance in links from the start page of its member's site
+func enqueue(q *queue.Queue, link string, depth int) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return
+	}
+	ctx := colly.NewContext()
+	// the context is serialized by the queue, so the depth is stored as a string
+	ctx.Put("depth", strconv.Itoa(depth))
+	q.AddRequest(&colly.Request{URL: u, Method: "GET", Ctx: ctx})
+}
+
+// crawlOutgoing visits each linked page outside of the webring once, without following any of its links, to find
+// out its title & description
+func crawlOutgoing(c *colly.Collector, outgoing map[string]bool, recorder *warcRecorder) {
+	c2 := c.Clone()
+	c2.AllowedDomains = nil
+	c2.MaxDepth = 1
+	if recorder != nil {
+		recorder.watch(c2)
+	}
+
+	c2.OnHTML("title", func(e *colly.HTMLElement) {
+		if title := cleanText(e.Text); len(title) > 0 {
+			fmt.Fprintln(output, "external-title", title, e.Request.URL, 0)
+		}
+	})
+	c2.OnHTML("meta[name=\"description\"], meta[property=\"og:description\"]", func(e *colly.HTMLElement) {
+		desc := cleanText(e.Attr("content"))
+		if len(desc) > 0 && len(desc) < 1500 {
+			fmt.Fprintln(output, "external-desc", desc, e.Request.URL, 0)
+		}
+	})
+
+	q2, _ := queue.New(
+		5, /* threads */
+		&queue.InMemoryQueueStorage{MaxSize: 100000},
+	)
+	for link := range outgoing {
+		q2.AddURL(link)
+	}
+	q2.Run(c2)
 }
@@ -0,0 +1,162 @@
+package crawler
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"lieu/urlnorm"
+)
+
+// parseSiteOptions reads the optional third column of a webring entry: space separated key=value pairs, e.g.
+// include=/~lupin/* exclude=/~lupin/drafts/* maxPages=500 maxDepth=3 tags=art,zines
+func parseSiteOptions(options string, link *WebringLink) {
+	for _, field := range strings.Fields(options) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		values := strings.Split(parts[1], ",")
+		switch parts[0] {
+		case "include":
+			link.Include = append(link.Include, values...)
+		case "exclude":
+			link.Exclude = append(link.Exclude, values...)
+		case "maxPages":
+			link.MaxPages, _ = strconv.Atoi(parts[1])
+		case "maxDepth":
+			link.MaxDepth, _ = strconv.Atoi(parts[1])
+		case "tags":
+			link.Tags = append(link.Tags, values...)
+		}
+	}
+}
+
+// globPattern turns a path glob into a regular expression matching the whole path. * matches any run of characters,
+// slashes included, and ? any single character
+func globPattern(glob string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// site is the part of a host a webring entry covers, along with the rules for crawling it
+type site struct {
+	WebringLink
+	host string
+	// the path the entry points to, if it points below the root of its host. shared hosts, such as tilde servers,
+	// have a site for every member, each limited to their own directory
+	base    string
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	// the number of requests made to the site
+	requests int
+}
+
+// scope decides which urls belong to which member of the webring, and whether they may be crawled
+type scope struct {
+	mutex      sync.Mutex
+	sites      []*site
+	normalizer *urlnorm.Normalizer
+}
+
+func newScope(links []WebringLink, normalizer *urlnorm.Normalizer) *scope {
+	s := &scope{normalizer: normalizer}
+	for _, link := range links {
+		normalized, ok := normalizer.Normalize(link.URL)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(normalized)
+		if err != nil {
+			continue
+		}
+		entry := &site{WebringLink: link, host: u.Host, base: u.Path}
+		for _, glob := range link.Include {
+			entry.include = append(entry.include, globPattern(glob))
+		}
+		for _, glob := range link.Exclude {
+			entry.exclude = append(entry.exclude, globPattern(glob))
+		}
+		s.sites = append(s.sites, entry)
+	}
+	return s
+}
+
+// siteOf returns the member a url belongs to: the one on the same host whose path is the longest prefix of the url's.
+// the url is normalized first, as a request may have been redirected to another form of its address, e.g. with www
+func (s *scope) siteOf(u *url.URL) *site {
+	if normalized, ok := s.normalizer.Normalize(u.String()); ok {
+		if parsed, err := url.Parse(normalized); err == nil {
+			u = parsed
+		}
+	}
+	var best *site
+	for _, entry := range s.sites {
+		if entry.host != u.Host {
+			continue
+		}
+		if entry.base != "" && u.Path != entry.base && !strings.HasPrefix(u.Path, entry.base+"/") {
+			continue
+		}
+		if best == nil || len(entry.base) > len(best.base) {
+			best = entry
+		}
+	}
+	return best
+}
+
+// allows reports whether the (normalized) url may be crawled: it has to belong to a member, be included by the
+// member's rules and not be excluded by them
+func (s *scope) allows(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	entry := s.siteOf(u)
+	if entry == nil {
+		return false
+	}
+	if len(entry.include) > 0 && !matchesAny(entry.include, u.Path) {
+		return false
+	}
+	return !matchesAny(entry.exclude, u.Path)
+}
+
+// request counts a request to a member's site, and reports false if the site has reached its maximum number of pages
+func (s *scope) request(u *url.URL) bool {
+	entry := s.siteOf(u)
+	if entry == nil || entry.MaxPages <= 0 {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry.requests++
+	return entry.requests <= entry.MaxPages
+}
+
+// withinDepth reports whether a link, found on a page at the given depth, is close enough to the start page of its
+// member's site. a link to another member starts over at that member's start page
+func (s *scope) withinDepth(from *url.URL, link *url.URL, depth int) (int, bool) {
+	entry := s.siteOf(link)
+	if entry == nil {
+		return 0, false
+	}
+	if s.siteOf(from) != entry {
+		depth = 0
+	}
+	depth++
+	return depth, entry.MaxDepth <= 0 || depth <= entry.MaxDepth
+}
+
+func matchesAny(patterns []*regexp.Regexp, path string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package crawler
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// domainStatus is what happened when fetching the pages of a single domain
+type domainStatus struct {
+	// responses per status code; network errors, such as failed dns lookups, are counted as status 0
+	statuses  map[int]int
+	durations []time.Duration
+}
+
+func (s *domainStatus) reachable() bool {
+	for status := range s.statuses {
+		if status > 0 && status < 400 {
+			return true
+		}
+	}
+	return false
+}
+
+// statusTracker records the outcome of every request made by a collector, per domain
+type statusTracker struct {
+	mutex   sync.Mutex
+	domains map[string]*domainStatus
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{domains: make(map[string]*domainStatus)}
+}
+
+func (t *statusTracker) record(r *colly.Response) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	domain := r.Request.URL.Hostname()
+	status, exists := t.domains[domain]
+	if !exists {
+		status = &domainStatus{statuses: make(map[int]int)}
+		t.domains[domain] = status
+	}
+	status.statuses[r.StatusCode]++
+	// the time until the first byte of the response, which leaves out the crawler's own delay between requests
+	if r.StatusCode > 0 && r.Trace != nil {
+		status.durations = append(status.durations, r.Trace.FirstByteDuration)
+	}
+}
+
+// watch starts tracking the requests of the collector
+func (t *statusTracker) watch(c *colly.Collector) {
+	c.TraceHTTP = true
+	c.OnResponse(func(r *colly.Response) {
+		t.record(r)
+	})
+	c.OnError(func(r *colly.Response, err error) {
+		t.record(r)
+	})
+}
+
+// printSiteStatus writes whether each site of the webring could be reached during the crawl. sites which were
+// never requested, e.g. due to being banned, are left out
+func (t *statusTracker) printSiteStatus(links []WebringLink) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, link := range links {
+		u, err := url.Parse(link.URL)
+		if err != nil {
+			continue
+		}
+		status, exists := t.domains[u.Hostname()]
+		if !exists {
+			continue
+		}
+		if status.reachable() {
+			fmt.Fprintln(output, "site-status", "ok", link.URL, link.Depth)
+		} else {
+			fmt.Fprintln(output, "site-status", "unreachable", link.URL, link.Depth)
+		}
+	}
+}
+
+// median returns the middle of the durations, which are sorted in place
+func median(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2]
+}
+
+// printCrawlStats writes how the requests to each site of the webring went: the number of requests, the errors
+// per status code (0 for network errors), the median response time & the urls cut off as likely crawler traps
+func (t *statusTracker) printCrawlStats(links []WebringLink, traps *trapDetector) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, link := range links {
+		u, err := url.Parse(link.URL)
+		if err != nil {
+			continue
+		}
+		status, exists := t.domains[u.Hostname()]
+		if !exists {
+			continue
+		}
+		var requests int
+		var errors []string
+		for code, count := range status.statuses {
+			requests += count
+			if code == 0 || code >= 400 {
+				errors = append(errors, fmt.Sprintf("%d:%d", code, count))
+			}
+		}
+		sort.Strings(errors)
+		fmt.Fprintf(output, "crawl-stats requests=%d errors=%s median_ms=%d cut_off=%s %s %d\n",
+			requests, strings.Join(errors, ","), median(status.durations).Milliseconds(), traps.summary(u.Hostname()),
+			link.URL, link.Depth)
+	}
+}
@@ -0,0 +1,255 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"lieu/util"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// a path with any segment occurring more often than this, e.g. /a/b/a/b/a/b, is most likely made up by relative links
+// resolved against ever longer paths
+const maxSegmentRepeats = 2
+
+// a page whose text is nearly the same as that of this many pages in the same section of its site, such as the empty
+// days of a calendar, has its links left unfollowed
+const maxNearDuplicates = 10
+
+// pages whose simhashes differ in at most this many bits are near-identical
+const maxTrapDistance = 3
+
+// pages with less text than this many shingles are never taken for near-duplicates, as nearly empty pages all hash
+// alike
+const minTrapFeatures = 10
+
+// the most simhashes remembered per section of a site
+const maxSectionHashes = 500
+
+// the reasons for cutting off urls, as reported per domain
+const (
+	cutRepeating = "repeating"
+	cutLong      = "long"
+	cutFanout    = "fanout"
+	cutDuplicate = "duplicate"
+	cutMaxPages  = "maxPages"
+)
+
+// cutOff is what was left uncrawled on a single domain, per reason
+type cutOff struct {
+	counts map[string]int
+	// the urls counted for each reason, as a link is often found on many pages
+	urls map[string]map[string]bool
+	// the first url cut off for each reason
+	examples map[string]string
+}
+
+// trapDetector keeps the crawler out of infinite spaces, such as calendars, faceted tag combinations & session urls,
+// which could otherwise fill the queue with the pages of a single site
+type trapDetector struct {
+	mutex        sync.Mutex
+	maxURLLength int
+	maxFanout    int
+	// the distinct urls queued under each path prefix, up to maxFanout
+	fanout map[string]map[string]bool
+	// the simhashes of the pages fetched in each section of a site
+	sections map[string][]uint64
+	cut      map[string]*cutOff
+}
+
+func newTrapDetector(maxURLLength, maxFanout int) *trapDetector {
+	return &trapDetector{
+		maxURLLength: maxURLLength,
+		maxFanout:    maxFanout,
+		fanout:       make(map[string]map[string]bool),
+		sections:     make(map[string][]uint64),
+		cut:          make(map[string]*cutOff),
+	}
+}
+
+// allows reports whether a link may be queued, noting it as cut off if it looks like part of a trap
+func (t *trapDetector) allows(link string, u *url.URL) bool {
+	reason := t.check(link, u)
+	if reason == "" {
+		return true
+	}
+	t.cutOff(u, reason)
+	return false
+}
+
+func (t *trapDetector) check(link string, u *url.URL) string {
+	if t.maxURLLength > 0 && len(link) > t.maxURLLength {
+		return cutLong
+	}
+	if repeatsSegments(u.Path) {
+		return cutRepeating
+	}
+	if t.maxFanout <= 0 {
+		return ""
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	prefix := u.Host + pathPrefix(u)
+	seen, exists := t.fanout[prefix]
+	if !exists {
+		seen = make(map[string]bool)
+		t.fanout[prefix] = seen
+	}
+	if seen[link] {
+		return ""
+	}
+	if len(seen) >= t.maxFanout {
+		return cutFanout
+	}
+	seen[link] = true
+	return ""
+}
+
+// nearDuplicate reports whether a fetched page is nearly the same as many others in its section of the site, noting
+// it as cut off if so
+func (t *trapDetector) nearDuplicate(u *url.URL, body []byte) bool {
+	hash, features := pageSimhash(body)
+	if features < minTrapFeatures {
+		return false
+	}
+	section := u.Host + pathSection(u.Path)
+	t.mutex.Lock()
+	var similar int
+	for _, other := range t.sections[section] {
+		if bits.OnesCount64(hash^other) <= maxTrapDistance {
+			similar++
+		}
+	}
+	if len(t.sections[section]) < maxSectionHashes {
+		t.sections[section] = append(t.sections[section], hash)
+	}
+	t.mutex.Unlock()
+	if similar < maxNearDuplicates {
+		return false
+	}
+	t.cutOff(u, cutDuplicate)
+	return true
+}
+
+// cutOff notes that a url was left uncrawled, or that its links were left unfollowed
+func (t *trapDetector) cutOff(u *url.URL, reason string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	domain := u.Hostname()
+	cut, exists := t.cut[domain]
+	if !exists {
+		cut = &cutOff{counts: make(map[string]int), urls: make(map[string]map[string]bool), examples: make(map[string]string)}
+		t.cut[domain] = cut
+	}
+	link := u.String()
+	if cut.urls[reason] == nil {
+		cut.urls[reason] = make(map[string]bool)
+	}
+	if cut.urls[reason][link] {
+		return
+	}
+	cut.urls[reason][link] = true
+	cut.counts[reason]++
+	if _, exists := cut.examples[reason]; !exists {
+		cut.examples[reason] = link
+	}
+}
+
+// summary describes what was cut off on a domain, e.g. fanout:120,duplicate:4, or returns an empty string if nothing was
+func (t *trapDetector) summary(domain string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	cut, exists := t.cut[domain]
+	if !exists {
+		return ""
+	}
+	var reasons []string
+	for reason, count := range cut.counts {
+		reasons = append(reasons, fmt.Sprintf("%s:%d", reason, count))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ",")
+}
+
+// logReport lists what was cut off on each domain, with an example url per reason
+func (t *trapDetector) logReport() {
+	t.mutex.Lock()
+	domains := make([]string, 0, len(t.cut))
+	for domain := range t.cut {
+		domains = append(domains, domain)
+	}
+	t.mutex.Unlock()
+	sort.Strings(domains)
+	for _, domain := range domains {
+		log.Println("cut off on", domain+":", t.summary(domain))
+		t.mutex.Lock()
+		examples := t.cut[domain].examples
+		reasons := make([]string, 0, len(examples))
+		for reason := range examples {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			log.Println("  e.g.", reason, examples[reason])
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// repeatsSegments reports whether any segment of the path occurs more than maxSegmentRepeats times
+func repeatsSegments(path string) bool {
+	counts := make(map[string]int)
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		counts[segment]++
+		if counts[segment] > maxSegmentRepeats {
+			return true
+		}
+	}
+	return false
+}
+
+// pathPrefix returns what a url's fan-out is counted against: the path itself for urls with a query, as the query
+// varies e.g. per date or tag combination, or else the directory the path is in
+func pathPrefix(u *url.URL) string {
+	if u.RawQuery != "" {
+		return u.Path + "?"
+	}
+	if i := strings.LastIndex(u.Path, "/"); i > 0 {
+		return u.Path[:i]
+	}
+	return "/"
+}
+
+// pathSection returns the first segment of a path, e.g. /calendar for /calendar/2024/05/17
+func pathSection(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	return "/" + segments[0]
+}
+
+var digits = regexp.MustCompile(`[0-9]+`)
+
+// pageSimhash hashes the text of a page, leaving out the navigation & other parts which are the same on every page.
+// numbers are hashed as if they were all the same, as the pages of a trap often differ in little else, e.g. dates.
+// it also returns the number of shingles hashed
+func pageSimhash(body []byte) (uint64, int) {
+	var s util.Simhash
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return s.Sum(), s.Features
+	}
+	content := doc.Find("body")
+	content.Find("script, style, noscript, nav, header, footer, aside").Remove()
+	s.Add(digits.ReplaceAllString(content.Text(), "0"))
+	return s.Sum(), s.Features
+}
@@ -0,0 +1,196 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"lieu/warc"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// warcRecorder writes every request made by the collectors it watches, and the response to it, to a WARC file
+type warcRecorder struct {
+	writer *warc.Writer
+}
+
+func newWarcRecorder(path string) (*warcRecorder, error) {
+	writer, err := warc.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	info := "software: lieu\r\nformat: WARC File Format 1.1\r\n"
+	if _, err = writer.WriteRecord("warcinfo", "", "application/warc-fields", []byte(info)); err != nil {
+		return nil, err
+	}
+	return &warcRecorder{writer: writer}, nil
+}
+
+// watch starts recording the requests of the collector
+func (w *warcRecorder) watch(c *colly.Collector) {
+	// colly only sees the response at the end of a chain of redirects, so each redirect is recorded as it is followed
+	c.SetRedirectHandler(func(req *http.Request, via []*http.Request) error {
+		if req.Response != nil {
+			w.recordRedirect(req.Response)
+		}
+		// the limit & header handling of colly's own redirect handler, which this one replaces
+		if len(via) >= 10 {
+			return http.ErrUseLastResponse
+		}
+		if req.URL.Host != via[len(via)-1].URL.Host {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	})
+	c.OnResponse(w.record)
+	// error responses, such as 404s, are kept too; requests that failed to get any response are not
+	c.OnError(func(r *colly.Response, err error) {
+		if r.StatusCode > 0 {
+			w.record(r)
+		}
+	})
+}
+
+func (w *warcRecorder) record(r *colly.Response) {
+	var header http.Header
+	if r.Request.Headers != nil {
+		header = *r.Request.Headers
+	}
+	w.write(r.Request.URL, responseBlock(r), r.Body, requestBlock(r.Request.Method, r.Request.URL, header))
+}
+
+// recordRedirect records a redirect as it was received, leaving its body to be read again by the http client
+func (w *warcRecorder) recordRedirect(res *http.Response) {
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		log.Println("failed to read redirect from", res.Request.URL, err)
+		return
+	}
+	header := res.Header.Clone()
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %s\r\n", res.Status)
+	header.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(body)
+	w.write(res.Request.URL, b.Bytes(), body, requestBlock(res.Request.Method, res.Request.URL, res.Request.Header))
+}
+
+func (w *warcRecorder) write(u *url.URL, response, payload, request []byte) {
+	uri := u.String()
+	id, err := w.writer.WriteRecord("response", uri, "application/http; msgtype=response", response,
+		"WARC-Payload-Digest", warc.Digest(payload))
+	if err == nil {
+		_, err = w.writer.WriteRecord("request", uri, "application/http; msgtype=request", request,
+			"WARC-Concurrent-To", id)
+	}
+	if err != nil {
+		log.Println("failed to write warc record for", uri, err)
+	}
+}
+
+func (w *warcRecorder) close() {
+	if err := w.writer.Close(); err != nil {
+		log.Println("failed to close warc file", err)
+	}
+}
+
+func requestBlock(method string, u *url.URL, header http.Header) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", method, u.RequestURI())
+	fmt.Fprintf(&b, "Host: %s\r\n", u.Host)
+	header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// responseBlock reconstructs the http response from what colly kept of it. the body has already been decompressed,
+// and converted to utf-8, so the headers are changed to match it
+func responseBlock(r *colly.Response) []byte {
+	header := make(http.Header)
+	if r.Headers != nil {
+		for name, values := range *r.Headers {
+			header[name] = values
+		}
+	}
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	if mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && params["charset"] != "" {
+		params["charset"] = "utf-8"
+		header.Set("Content-Type", mime.FormatMediaType(mediatype, params))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", r.StatusCode, http.StatusText(r.StatusCode))
+	header.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(r.Body)
+	return b.Bytes()
+}
+
+// a replayed response carries the time it was captured in this header, as given by its record's WARC-Date
+const capturedHeader = "Lieu-Captured"
+
+// replayTransport answers requests with the responses captured in WARC files, instead of going over the network.
+// urls which were never captured get a 404
+type replayTransport struct {
+	index *warc.Index
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	uri := req.URL.String()
+	record, err := t.index.Lookup(uri)
+	// the capture may differ from the link by a trailing slash
+	if err != nil && strings.HasSuffix(uri, "/") {
+		record, err = t.index.Lookup(strings.TrimSuffix(uri, "/"))
+	} else if err != nil {
+		record, err = t.index.Lookup(uri + "/")
+	}
+	if err != nil {
+		return &http.Response{
+			Status:     "404 Not Found",
+			StatusCode: http.StatusNotFound,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(record.Block)), req)
+	if err != nil {
+		return nil, err
+	}
+	// third-party archives keep bodies the way they were sent
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(zr)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		res.Header.Del("Content-Encoding")
+		res.Header.Del("Content-Length")
+		res.ContentLength = int64(len(body))
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	res.Header.Set(capturedHeader, record.Header.Get("WARC-Date"))
+	return res, nil
+}
@@ -12,20 +12,27 @@ select url from inv_index where word = "<word>" group by url order by sum(score)
 */
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"lieu/types"
 	"lieu/util"
 	"log"
+	"math"
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var languageCodeSanityRegex = regexp.MustCompile("^[a-zA-Z\\-0-9]+$")
 
+// escapes the wildcards of a LIKE pattern, for use with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func InitDB(filepath string) *sql.DB {
 	db, err := sql.Open("sqlite3", filepath)
 	if err != nil {
@@ -43,7 +50,9 @@ func createTables(db *sql.DB) {
 	queries := []string{`
     CREATE TABLE IF NOT EXISTS domains (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
-        domain TEXT NOT NULL UNIQUE
+        domain TEXT NOT NULL UNIQUE,
+        unreachable_since TEXT,
+        tags TEXT
     );
     `,
 		`
@@ -61,6 +70,16 @@ func createTables(db *sql.DB) {
         lang TEXT,
         domain TEXT NOT NULL,
         depth INTEGER NOT NULL DEFAULT 0,
+        modified TEXT,
+        first_seen TEXT,
+        inbound INTEGER NOT NULL DEFAULT 0,
+        authority REAL NOT NULL DEFAULT 0,
+        archive_hash TEXT,
+        archived TEXT,
+        last_changed TEXT,
+        changes INTEGER NOT NULL DEFAULT 0,
+        simhash INTEGER,
+        duplicate_of TEXT,
         FOREIGN KEY(domain) REFERENCES domains(domain)
     );
     `,
@@ -69,7 +88,8 @@ func createTables(db *sql.DB) {
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         url TEXT NOT NULL UNIQUE,
         domain TEXT NOT NULL,
-        title TEXT
+        title TEXT,
+        about TEXT
     );
     `,
 		`
@@ -79,6 +99,61 @@ func createTables(db *sql.DB) {
         url TEXT NOT NULL,
         FOREIGN KEY(url) REFERENCES pages(url)
     )`,
+		`
+    CREATE TABLE IF NOT EXISTS links (
+        source TEXT NOT NULL,
+        target TEXT NOT NULL,
+        source_domain TEXT NOT NULL,
+        target_domain TEXT NOT NULL,
+        webring INTEGER NOT NULL DEFAULT 0,
+        anchor TEXT,
+        UNIQUE(source, target),
+        FOREIGN KEY(source) REFERENCES pages(url)
+    )`,
+		`
+    CREATE TABLE IF NOT EXISTS previous_outgoing_domains (
+        domain TEXT NOT NULL UNIQUE,
+        sites INTEGER NOT NULL,
+        pages INTEGER NOT NULL,
+        crawl TEXT
+    )`,
+		`
+    CREATE TABLE IF NOT EXISTS link_status (
+        url TEXT NOT NULL UNIQUE,
+        status INTEGER NOT NULL DEFAULT 0,
+        problem TEXT,
+        final_url TEXT,
+        checked TEXT
+    )`,
+		`
+    CREATE TABLE IF NOT EXISTS crawl_history (
+        run TEXT NOT NULL,
+        domain TEXT NOT NULL,
+        requests INTEGER NOT NULL DEFAULT 0,
+        errors INTEGER NOT NULL DEFAULT 0,
+        error_codes TEXT,
+        median_ms INTEGER NOT NULL DEFAULT 0,
+        pages INTEGER NOT NULL DEFAULT 0,
+        cut_off TEXT,
+        UNIQUE(run, domain)
+    )`,
+		`
+    CREATE TABLE IF NOT EXISTS page_history (
+        url TEXT NOT NULL,
+        run TEXT NOT NULL,
+        fingerprint TEXT NOT NULL,
+        UNIQUE(url, run)
+    )`,
+		`CREATE INDEX IF NOT EXISTS links_target ON links(target)`,
+		`CREATE INDEX IF NOT EXISTS links_source_domain ON links(source_domain)`,
+		`CREATE INDEX IF NOT EXISTS links_target_domain ON links(target_domain)`,
+		`CREATE INDEX IF NOT EXISTS inv_index_word ON inv_index(word)`,
+		`
+    CREATE TABLE IF NOT EXISTS folded_words (
+        word TEXT NOT NULL UNIQUE,
+        folded TEXT NOT NULL
+    )`,
+		`CREATE INDEX IF NOT EXISTS folded_words_folded ON folded_words(folded)`,
 		`CREATE VIRTUAL TABLE IF NOT EXISTS external_links USING fts5 (url, tokenize="trigram")`,
 	}
 
@@ -99,44 +174,559 @@ query params:
 &order=score, &order=count
 */
 
-var emptyStringArray = []string{}
+// the original lieu ranking: list pages of lower precrawl depths first, and don't apply any boosts
+var defaultRanking = types.Ranking{Synonyms: 0.5, DepthDecay: "strict"}
 
 func SearchWordsByScore(db *sql.DB, words []string) []types.PageData {
-	return SearchWords(db, words, true, emptyStringArray, emptyStringArray, emptyStringArray)
+	return SearchWords(db, types.SearchQuery{Words: words}, true, defaultRanking)
 }
 
 func SearchWordsBySite(db *sql.DB, words []string, domain string) []types.PageData {
 	// search words by site is same as search words by score, but adds a domain condition
-	return SearchWords(db, words, true, []string{domain}, emptyStringArray, emptyStringArray)
+	return SearchWords(db, types.SearchQuery{Words: words, Domains: []string{domain}}, true, defaultRanking)
 }
 
 func SearchWordsByCount(db *sql.DB, words []string) []types.PageData {
-	return SearchWords(db, words, false, emptyStringArray, emptyStringArray, emptyStringArray)
+	return SearchWords(db, types.SearchQuery{Words: words}, false, defaultRanking)
 }
 
+// the most pages of the webring listed as linking to a single outgoing search result
+const maxLinkedFrom = 10
+
+// FulltextSearchWords searches the links to pages outside of the webring, by their url & the titles they were given.
+// pages linked to by the most members come first
 func FulltextSearchWords(db *sql.DB, phrase string) []types.PageData {
-	query := fmt.Sprintf(`SELECT url from external_links WHERE url MATCH ? GROUP BY url ORDER BY RANDOM() LIMIT 30`)
+	pattern := "%" + likeEscaper.Replace(phrase) + "%"
+	query := `
+    SELECT e.url, COALESCE(x.title, ''), COALESCE(x.about, ''), COUNT(DISTINCT l.source_domain) AS members
+    FROM (
+        SELECT url FROM external_links WHERE url MATCH ?
+        UNION
+        SELECT url FROM external_pages WHERE title LIKE ? ESCAPE '\' OR about LIKE ? ESCAPE '\'
+    ) e
+    LEFT JOIN external_pages x ON x.url = e.url
+    LEFT JOIN links l ON l.target = e.url AND l.webring = 0
+    GROUP BY e.url
+    ORDER BY members DESC, COUNT(DISTINCT l.source) DESC, RANDOM()
+    LIMIT 30`
 
 	stmt, err := db.Prepare(query)
 	util.Check(err)
 	defer stmt.Close()
 
-	rows, err := stmt.Query(phrase)
+	rows, err := stmt.Query(phrase, pattern, pattern)
 	util.Check(err)
 	defer rows.Close()
 
 	var pageData types.PageData
 	var pages []types.PageData
 	for rows.Next() {
-		if err := rows.Scan(&pageData.URL); err != nil {
+		if err := rows.Scan(&pageData.URL, &pageData.Title, &pageData.About, &pageData.Inbound); err != nil {
 			log.Fatalln(err)
 		}
-		pageData.Title = pageData.URL
 		pages = append(pages, pageData)
 	}
+	addLinkedFrom(db, pages)
 	return pages
 }
 
+// addLinkedFrom lists the pages of the webring linking to each of the given outgoing pages
+func addLinkedFrom(db *sql.DB, pages []types.PageData) {
+	if len(pages) == 0 {
+		return
+	}
+	placeholders := make([]string, 0, len(pages))
+	args := make([]interface{}, 0, len(pages))
+	index := make(map[string]int, len(pages))
+	for i, page := range pages {
+		placeholders = append(placeholders, "?")
+		args = append(args, page.URL)
+		index[page.URL] = i
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+    SELECT target, source FROM links
+    WHERE webring = 0 AND target IN (%s)
+    ORDER BY source ASC`, strings.Join(placeholders, ", ")), args...)
+	util.Check(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var target, source string
+		util.Check(rows.Scan(&target, &source))
+		i := index[target]
+		if len(pages[i].LinkedFrom) < maxLinkedFrom {
+			pages[i].LinkedFrom = append(pages[i].LinkedFrom, source)
+		}
+	}
+}
+
+// SuggestTerms returns indexed terms starting with the given prefix, the terms found on the most pages first
+func SuggestTerms(db *sql.DB, prefix string, limit int) []string {
+	if len(prefix) < 2 || limit <= 0 {
+		return []string{}
+	}
+	// a range instead of LIKE, so that the word index can be used
+	stmt, err := db.Prepare(`
+    SELECT word FROM inv_index
+    WHERE word >= ? AND word < ?
+    GROUP BY word
+    ORDER BY COUNT(DISTINCT url) DESC
+    LIMIT ?`)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(prefix, prefix+string(utf8.MaxRune), limit)
+	util.Check(err)
+	defer rows.Close()
+
+	var terms []string
+	for rows.Next() {
+		var term string
+		util.Check(rows.Scan(&term))
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// SuggestTitles returns page titles starting with the given prefix
+func SuggestTitles(db *sql.DB, prefix string, limit int) []string {
+	if len(prefix) < 2 || limit <= 0 {
+		return []string{}
+	}
+	stmt, err := db.Prepare(`SELECT DISTINCT title FROM pages WHERE title LIKE ? ESCAPE '\' LIMIT ?`)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(likeEscaper.Replace(prefix)+"%", limit)
+	util.Check(err)
+	defer rows.Close()
+
+	var titles []string
+	for rows.Next() {
+		var title string
+		util.Check(rows.Scan(&title))
+		titles = append(titles, title)
+	}
+	return titles
+}
+
+// GetFirstSeenDates reads the date each page was first ingested from the database at the given path, without
+// modifying it. databases created by older versions of lieu don't keep track of this, and result in an empty map
+func GetFirstSeenDates(filepath string) map[string]string {
+	dates := make(map[string]string)
+	db, err := sql.Open("sqlite3", filepath)
+	util.Check(err)
+	defer db.Close()
+
+	rows, err := db.Query("SELECT url, first_seen FROM pages WHERE first_seen IS NOT NULL")
+	if err != nil {
+		log.Println("no first seen dates in previous database:", err)
+		return dates
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pageurl, date string
+		util.Check(rows.Scan(&pageurl, &date))
+		dates[pageurl] = date
+	}
+	return dates
+}
+
+// GetOutgoingDomainCounts reads how often each domain outside of the webring was linked to from a previous
+// database, along with the date of that crawl
+func GetOutgoingDomainCounts(filepath string) (map[string]types.OutgoingDomain, string) {
+	counts := make(map[string]types.OutgoingDomain)
+	db, err := sql.Open("sqlite3", filepath)
+	util.Check(err)
+	defer db.Close()
+
+	rows, err := db.Query(`
+    SELECT target_domain, COUNT(DISTINCT source_domain), COUNT(DISTINCT source) FROM links
+    WHERE webring = 0 GROUP BY target_domain`)
+	if err != nil {
+		log.Println("no outgoing links in previous database:", err)
+		return counts, ""
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var domain types.OutgoingDomain
+		util.Check(rows.Scan(&domain.Domain, &domain.Sites, &domain.Pages))
+		counts[domain.Domain] = domain
+	}
+	return counts, GetLastCrawl(db)
+}
+
+// InsertPreviousOutgoingDomains keeps the outgoing link counts of the previous crawl, to compare the current one to
+func InsertPreviousOutgoingDomains(db *sql.DB, counts map[string]types.OutgoingDomain, crawl string) {
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO previous_outgoing_domains(domain, sites, pages, crawl) VALUES (?, ?, ?, ?)")
+	util.Check(err)
+	defer stmt.Close()
+	for _, domain := range counts {
+		_, err = stmt.Exec(domain.Domain, domain.Sites, domain.Pages, crawl)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+// GetPreviousCrawl returns the date of the crawl outgoing links are compared to, if any
+func GetPreviousCrawl(db *sql.DB) string {
+	var crawl string
+	err := db.QueryRow("SELECT COALESCE(MAX(crawl), '') FROM previous_outgoing_domains").Scan(&crawl)
+	util.Check(err)
+	return crawl
+}
+
+// GetOutgoingDomains ranks the domains outside of the webring by the number of members linking to them
+func GetOutgoingDomains(db *sql.DB, limit int) []types.OutgoingDomain {
+	stmt, err := db.Prepare(`
+    SELECT l.target_domain, COUNT(DISTINCT l.source_domain), COUNT(DISTINCT l.source), COUNT(*),
+        COALESCE(prev.sites, 0), prev.domain IS NULL
+    FROM links l LEFT JOIN previous_outgoing_domains prev ON prev.domain = l.target_domain
+    WHERE l.webring = 0 AND l.target_domain != ''
+    GROUP BY l.target_domain
+    ORDER BY COUNT(DISTINCT l.source_domain) DESC, COUNT(DISTINCT l.source) DESC, l.target_domain ASC
+    LIMIT ?`)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(limit)
+	util.Check(err)
+	defer rows.Close()
+
+	hasPrevious := GetPreviousCrawl(db) != ""
+	var domains []types.OutgoingDomain
+	for rows.Next() {
+		var domain types.OutgoingDomain
+		var previousSites int
+		var missing bool
+		util.Check(rows.Scan(&domain.Domain, &domain.Sites, &domain.Pages, &domain.Links, &previousSites, &missing))
+		if hasPrevious {
+			domain.Trend = domain.Sites - previousSites
+			domain.New = missing
+		}
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// GetOutgoingLinks returns the links from members of the webring to the given domain outside of it
+func GetOutgoingLinks(db *sql.DB, domain string, limit int) []types.Link {
+	stmt, err := db.Prepare(`
+    SELECT source, target, COALESCE(anchor, '') FROM links
+    WHERE webring = 0 AND target_domain = ?
+    ORDER BY target ASC, source ASC
+    LIMIT ?`)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(domain, limit)
+	util.Check(err)
+	defer rows.Close()
+
+	var links []types.Link
+	for rows.Next() {
+		var link types.Link
+		util.Check(rows.Scan(&link.Source, &link.Target, &link.Anchor))
+		links = append(links, link)
+	}
+	return links
+}
+
+// GetLinkTargets returns every page linked to from the webring
+func GetLinkTargets(db *sql.DB) []string {
+	rows, err := db.Query("SELECT DISTINCT target FROM links ORDER BY target_domain, target")
+	util.Check(err)
+	defer rows.Close()
+
+	var targets []string
+	for rows.Next() {
+		var target string
+		util.Check(rows.Scan(&target))
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// UpdateLinkStatuses stores the outcome of checking links for rot, replacing the outcome of earlier checks
+func UpdateLinkStatuses(db *sql.DB, statuses []types.LinkStatus) {
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO link_status(url, status, problem, final_url, checked) VALUES (?, ?, ?, ?, ?)")
+	util.Check(err)
+	defer stmt.Close()
+	for _, status := range statuses {
+		var problem, finalURL interface{}
+		if status.Problem != "" {
+			problem = status.Problem
+		}
+		if status.FinalURL != "" {
+			finalURL = status.FinalURL
+		}
+		_, err = stmt.Exec(status.URL, status.Status, problem, finalURL, status.Checked)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+// GetBrokenLinks returns the broken links found on the pages of a domain, or of all domains if it is empty
+func GetBrokenLinks(db *sql.DB, domain string) []types.BrokenLink {
+	stmt, err := db.Prepare(`
+    SELECT l.source_domain, l.source, l.target, s.problem, COALESCE(s.checked, '')
+    FROM links l INNER JOIN link_status s ON s.url = l.target
+    WHERE s.problem IS NOT NULL AND (? = '' OR l.source_domain = ?)
+    ORDER BY l.source_domain ASC, l.source ASC, l.target ASC`)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(domain, domain)
+	util.Check(err)
+	defer rows.Close()
+
+	var links []types.BrokenLink
+	for rows.Next() {
+		var link types.BrokenLink
+		util.Check(rows.Scan(&link.Domain, &link.Source, &link.Target, &link.Problem, &link.Checked))
+		links = append(links, link)
+	}
+	return links
+}
+
+// GetBrokenLinkCounts counts the broken links found on the pages of each domain
+func GetBrokenLinkCounts(db *sql.DB) []types.Count {
+	return countRows(db, `
+    SELECT l.source_domain, COUNT(*)
+    FROM links l INNER JOIN link_status s ON s.url = l.target
+    WHERE s.problem IS NOT NULL
+    GROUP BY l.source_domain ORDER BY COUNT(*) DESC, l.source_domain ASC`)
+}
+
+// attachPrevious makes the previous database available as "previous" to the returned connection. attached databases
+// only exist for the connection that attached them, so the connection has to be used for all queries involving it
+func attachPrevious(ctx context.Context, db *sql.DB, previousFilepath string) (*sql.Conn, func()) {
+	conn, err := db.Conn(ctx)
+	util.Check(err)
+	_, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS previous", previousFilepath)
+	util.Check(err)
+	return conn, func() {
+		conn.ExecContext(ctx, "DETACH DATABASE previous")
+		conn.Close()
+	}
+}
+
+// CopyHistory carries the history of earlier crawls, and of the pages seen in them, over from the previous database
+func CopyHistory(db *sql.DB, previousFilepath string) {
+	ctx := context.Background()
+	conn, detach := attachPrevious(ctx, db, previousFilepath)
+	defer detach()
+	_, err := conn.ExecContext(ctx, `
+    INSERT OR IGNORE INTO crawl_history(run, domain, requests, errors, error_codes, median_ms, pages, cut_off)
+    SELECT run, domain, requests, errors, error_codes, median_ms, pages, cut_off FROM previous.crawl_history`)
+	if err != nil {
+		// databases from before crawler traps were reported have no cut_off column
+		_, err = conn.ExecContext(ctx, `
+    INSERT OR IGNORE INTO crawl_history(run, domain, requests, errors, error_codes, median_ms, pages)
+    SELECT run, domain, requests, errors, error_codes, median_ms, pages FROM previous.crawl_history`)
+	}
+	if err != nil {
+		log.Println("no crawl history in previous database:", err)
+	}
+	_, err = conn.ExecContext(ctx, `
+    INSERT OR IGNORE INTO page_history(url, run, fingerprint)
+    SELECT url, run, fingerprint FROM previous.page_history`)
+	if err != nil {
+		log.Println("no page history in previous database:", err)
+	}
+}
+
+// InsertPageHistory records the fingerprint of the contents of each page seen in this run, identified by the time of
+// the ingest. databases from before runs had a time identify them by the date alone, which sorts before any time of
+// that day
+func InsertPageHistory(db *sql.DB, run string, fingerprints map[string]string) {
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO page_history(url, run, fingerprint) VALUES (?, ?, ?)")
+	util.Check(err)
+	defer stmt.Close()
+	for url, fingerprint := range fingerprints {
+		_, err = stmt.Exec(url, run, fingerprint)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+// UpdatePageChanges sets when each page was first seen, when it last changed, and how many times, from the history
+// of its fingerprints. a page which never changed has no last_changed date
+func UpdatePageChanges(db *sql.DB) {
+	_, err := db.Exec(`
+    WITH history AS (
+        SELECT url, run, fingerprint != LAG(fingerprint) OVER (PARTITION BY url ORDER BY run) AS changed
+        FROM page_history
+    ), changes AS (
+        SELECT url, SUBSTR(MIN(run), 1, 10) AS first_seen, SUBSTR(MAX(CASE WHEN changed THEN run END), 1, 10) AS last_changed,
+            COALESCE(SUM(changed), 0) AS changes
+        FROM history GROUP BY url
+    )
+    UPDATE pages SET last_changed = changes.last_changed, changes = changes.changes,
+        -- a page missing from a crawl in between is not new when it comes back
+        first_seen = MIN(COALESCE(pages.first_seen, changes.first_seen), changes.first_seen)
+    FROM changes WHERE changes.url = pages.url`)
+	util.Check(err)
+}
+
+// GetPageHistory returns a page along with its fingerprint as of each run it was seen in, most recent first
+func GetPageHistory(db *sql.DB, pageurl string) (types.PageData, []types.PageSnapshot, bool) {
+	var page types.PageData
+	err := db.QueryRow(`
+    SELECT url, COALESCE(title, ''), COALESCE(about, ''), COALESCE(first_seen, ''), COALESCE(last_changed, ''), changes
+    FROM pages WHERE url = ?`, pageurl).Scan(&page.URL, &page.Title, &page.About, &page.FirstSeen, &page.LastChanged, &page.Changes)
+	if err == sql.ErrNoRows {
+		return page, nil, false
+	}
+	util.Check(err)
+
+	rows, err := db.Query(`
+    SELECT run, fingerprint, COALESCE(fingerprint != LAG(fingerprint) OVER (ORDER BY run), 0) AS changed
+    FROM page_history WHERE url = ?
+    ORDER BY run DESC`, pageurl)
+	util.Check(err)
+	defer rows.Close()
+
+	var history []types.PageSnapshot
+	for rows.Next() {
+		var snapshot types.PageSnapshot
+		util.Check(rows.Scan(&snapshot.Run, &snapshot.Fingerprint, &snapshot.Changed))
+		history = append(history, snapshot)
+	}
+	return page, history, true
+}
+
+// InsertCrawlHistory records how crawling each site went, along with the number of pages indexed for it. pages kept
+// for unreachable sites don't count as indexed
+func InsertCrawlHistory(db *sql.DB, run string, stats []types.CrawlStats) {
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare(`
+    INSERT OR REPLACE INTO crawl_history(run, domain, requests, errors, error_codes, median_ms, cut_off, pages)
+    VALUES (?, ?, ?, ?, ?, ?, ?, (
+        SELECT COUNT(*) FROM pages p INNER JOIN domains d ON d.domain = p.domain
+        WHERE p.domain = ? AND d.unreachable_since IS NULL
+    ))`)
+	util.Check(err)
+	defer stmt.Close()
+	for _, s := range stats {
+		_, err = stmt.Exec(run, s.Domain, s.Requests, s.Errors, s.ErrorCodes, s.MedianMS, s.CutOff, s.Domain)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+// GetCrawlHistory returns the history of the most recent crawls of each site, oldest first
+func GetCrawlHistory(db *sql.DB, runs int) []types.CrawlStats {
+	stmt, err := db.Prepare(`
+    SELECT run, domain, requests, errors, COALESCE(error_codes, ''), median_ms, pages, COALESCE(cut_off, '') FROM crawl_history
+    WHERE run IN (SELECT DISTINCT run FROM crawl_history ORDER BY run DESC LIMIT ?)
+    ORDER BY domain ASC, run ASC`)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(runs)
+	util.Check(err)
+	defer rows.Close()
+
+	var history []types.CrawlStats
+	for rows.Next() {
+		var s types.CrawlStats
+		util.Check(rows.Scan(&s.Run, &s.Domain, &s.Requests, &s.Errors, &s.ErrorCodes, &s.MedianMS, &s.Pages, &s.CutOff))
+		history = append(history, s)
+	}
+	return history
+}
+
+// previousColumns lists those of the columns which the table has in the previous database, which may have been
+// created by an older version of lieu
+func previousColumns(ctx context.Context, conn *sql.Conn, table string, columns ...string) string {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA previous.table_info(%s)", table))
+	util.Check(err)
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, kind string
+		var value sql.NullString
+		util.Check(rows.Scan(&cid, &name, &kind, &notnull, &value, &pk))
+		existing[name] = true
+	}
+	var shared []string
+	for _, column := range columns {
+		if existing[column] {
+			shared = append(shared, column)
+		}
+	}
+	return strings.Join(shared, ", ")
+}
+
+// KeepUnreachableSites copies the pages of sites which could not be reached during the crawl from the previous
+// database, as long as they have been unreachable for no longer than the grace period (in days)
+func KeepUnreachableSites(db *sql.DB, previousFilepath string, domains []string, date string, gracePeriod int) {
+	if len(domains) == 0 || gracePeriod <= 0 {
+		return
+	}
+	ctx := context.Background()
+	conn, detach := attachPrevious(ctx, db, previousFilepath)
+	defer detach()
+	var err error
+	pageColumns := previousColumns(ctx, conn, "pages",
+		"url", "title", "about", "lang", "domain", "depth", "modified", "first_seen", "archive_hash", "archived", "simhash")
+	linkColumns := previousColumns(ctx, conn, "links", "source", "target", "source_domain", "target_domain", "webring", "anchor")
+
+	for _, domain := range domains {
+		var crawled int
+		util.Check(conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM pages WHERE domain = ?", domain).Scan(&crawled))
+		if crawled > 0 {
+			// some pages could be fetched after all
+			continue
+		}
+		var previousPages int
+		err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM previous.pages WHERE domain = ?", domain).Scan(&previousPages)
+		if err != nil || previousPages == 0 {
+			// nothing to keep
+			continue
+		}
+		since := date
+		var previousSince sql.NullString
+		// databases from before unreachable sites were kept have no unreachable_since column, which is fine
+		err = conn.QueryRowContext(ctx, "SELECT unreachable_since FROM previous.domains WHERE domain = ?", domain).Scan(&previousSince)
+		if err == nil && previousSince.Valid && previousSince.String != "" {
+			since = previousSince.String
+		}
+		if sinceDate, err := time.Parse("2006-01-02", since); err == nil {
+			today, _ := time.Parse("2006-01-02", date)
+			if today.Sub(sinceDate) > time.Duration(gracePeriod)*24*time.Hour {
+				log.Println("dropping", domain, "unreachable since", since)
+				continue
+			}
+		}
+
+		statements := []string{
+			"INSERT OR IGNORE INTO domains(domain) VALUES (?)",
+			fmt.Sprintf(`INSERT OR IGNORE INTO pages(%[1]s) SELECT %[1]s FROM previous.pages WHERE domain = ?`, pageColumns),
+			`INSERT INTO inv_index(word, score, url)
+            SELECT word, score, url FROM previous.inv_index WHERE url IN (SELECT url FROM previous.pages WHERE domain = ?)`,
+			fmt.Sprintf(`INSERT OR IGNORE INTO links(%[1]s) SELECT %[1]s FROM previous.links WHERE source_domain = ?`, linkColumns),
+		}
+		for _, stmt := range statements {
+			_, err = conn.ExecContext(ctx, stmt, domain)
+			util.Check(err)
+		}
+		_, err = conn.ExecContext(ctx, "UPDATE domains SET unreachable_since = ? WHERE domain = ?", since, domain)
+		util.Check(err)
+		log.Println("kept the pages of", domain, "unreachable since", since)
+	}
+}
+
 func UpdateCrawlDate(db *sql.DB, date string) {
 	stmt := `INSERT OR IGNORE INTO stats(last_crawl) VALUES (?)`
 	_, err := db.Exec(stmt, date)
@@ -160,6 +750,18 @@ func GetLastCrawl(db *sql.DB) string {
 	return date
 }
 
+// GetTermPageCount returns the number of pages the given term has been indexed for
+func GetTermPageCount(db *sql.DB, term string) int {
+	stmt, err := db.Prepare("SELECT COUNT(DISTINCT url) FROM inv_index WHERE word = ?;")
+	util.Check(err)
+	defer stmt.Close()
+
+	var count int
+	err = stmt.QueryRow(term).Scan(&count)
+	util.Check(err)
+	return count
+}
+
 func GetDomainCount(db *sql.DB) int {
 	return countQuery(db, "domains")
 }
@@ -172,6 +774,183 @@ func GetWordCount(db *sql.DB) int {
 	return countQuery(db, "inv_index")
 }
 
+// UpdateDomainTags sets the tags given to each domain in the webring file
+func UpdateDomainTags(db *sql.DB, tags map[string][]string) {
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare("UPDATE domains SET tags = ? WHERE domain = ?")
+	util.Check(err)
+	defer stmt.Close()
+	for domain, domainTags := range tags {
+		_, err = stmt.Exec(strings.Join(domainTags, ","), domain)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+// GetSites lists the indexed domains, described by their homepage (the page with the shortest url). filter narrows
+// the sites down to those mentioning it in their domain, title, description or tags. sites can be ordered by "pages"
+// (most pages first), "depth" (lowest precrawl depth first) or, by default, their domain
+func GetSites(db *sql.DB, filter, lang, order string) []types.SiteData {
+	orderBy := "p.domain ASC"
+	switch order {
+	case "pages":
+		orderBy = "COUNT(*) DESC, p.domain ASC"
+	case "depth":
+		orderBy = "MIN(p.depth) ASC, p.domain ASC"
+	}
+
+	pattern := "%" + likeEscaper.Replace(filter) + "%"
+	stmt, err := db.Prepare(fmt.Sprintf(`
+    WITH home AS (
+        SELECT domain, url, title, about, lang, ROW_NUMBER() OVER (PARTITION BY domain ORDER BY LENGTH(url) ASC, url ASC) AS n
+        FROM pages
+    )
+    SELECT p.domain, h.url, COALESCE(h.title, ''), COALESCE(h.about, ''), COALESCE(NULLIF(h.lang, ''), MAX(p.lang), ''), MIN(p.depth), COUNT(*),
+        COALESCE(d.unreachable_since, ''), COALESCE(d.tags, '')
+    FROM pages p INNER JOIN home h ON h.domain = p.domain AND h.n = 1
+    LEFT JOIN domains d ON d.domain = p.domain
+    WHERE (p.domain LIKE ? ESCAPE '\' OR h.title LIKE ? ESCAPE '\' OR h.about LIKE ? ESCAPE '\' OR d.tags LIKE ? ESCAPE '\')
+    GROUP BY p.domain
+    HAVING (? = '' OR COALESCE(NULLIF(h.lang, ''), MAX(p.lang), '') LIKE ? ESCAPE '\')
+    ORDER BY %s
+    `, orderBy))
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(pattern, pattern, pattern, pattern, lang, likeEscaper.Replace(lang)+"%")
+	util.Check(err)
+	defer rows.Close()
+
+	var sites []types.SiteData
+	for rows.Next() {
+		var site types.SiteData
+		var tags string
+		err = rows.Scan(&site.Domain, &site.URL, &site.Title, &site.About, &site.Lang, &site.Depth, &site.Pages, &site.Unreachable, &tags)
+		util.Check(err)
+		if tags != "" {
+			site.Tags = strings.Split(tags, ",")
+		}
+		sites = append(sites, site)
+	}
+	return sites
+}
+
+// GetSite returns the directory entry of a single domain, and whether it exists in the index
+func GetSite(db *sql.DB, domain string) (types.SiteData, bool) {
+	for _, site := range GetSites(db, domain, "", "") {
+		if site.Domain == domain {
+			return site, true
+		}
+	}
+	return types.SiteData{}, false
+}
+
+// GetSiteLanguages counts the languages a site's pages are written in
+func GetSiteLanguages(db *sql.DB, domain string) []types.Count {
+	return countRows(db, `
+    SELECT lang, COUNT(*) FROM pages
+    WHERE domain = ? AND lang IS NOT NULL AND lang != ''
+    GROUP BY lang ORDER BY COUNT(*) DESC`, domain)
+}
+
+// GetSiteTopTerms returns the terms found on most of a site's pages
+func GetSiteTopTerms(db *sql.DB, domain string, limit int) []types.Count {
+	return countRows(db, `
+    SELECT inv.word, COUNT(DISTINCT inv.url) FROM inv_index inv
+    INNER JOIN pages p ON inv.url = p.url
+    WHERE p.domain = ?
+    GROUP BY inv.word ORDER BY COUNT(DISTINCT inv.url) DESC, SUM(inv.score) DESC
+    LIMIT ?`, domain, limit)
+}
+
+// GetSiteOutgoingDomains returns the domains a site links to the most, counted by the number of links
+func GetSiteOutgoingDomains(db *sql.DB, domain string, limit int) []types.Count {
+	return countRows(db, `
+    SELECT target_domain, COUNT(*) FROM links
+    WHERE source_domain = ? AND target_domain != source_domain
+    GROUP BY target_domain ORDER BY COUNT(*) DESC, target_domain ASC
+    LIMIT ?`, domain, limit)
+}
+
+// GetMostLinkedPages returns the pages of a site which other members of the webring link to the most
+func GetMostLinkedPages(db *sql.DB, domain string, limit int) []types.PageData {
+	stmt, err := db.Prepare(`
+    SELECT url, COALESCE(title, ''), COALESCE(about, ''), inbound FROM pages
+    WHERE domain = ? AND inbound > 0
+    ORDER BY inbound DESC, url ASC
+    LIMIT ?`)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(domain, limit)
+	util.Check(err)
+	defer rows.Close()
+
+	var pages []types.PageData
+	for rows.Next() {
+		var page types.PageData
+		util.Check(rows.Scan(&page.URL, &page.Title, &page.About, &page.Inbound))
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// GetInboundLinks returns links from other members of the webring to pages of the given domain
+func GetInboundLinks(db *sql.DB, domain string, limit int) []types.Link {
+	stmt, err := db.Prepare(`
+    SELECT source, target FROM links
+    WHERE target_domain = ? AND source_domain != target_domain AND webring = 1
+    ORDER BY source_domain ASC, source ASC
+    LIMIT ?`)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(domain, limit)
+	util.Check(err)
+	defer rows.Close()
+
+	var links []types.Link
+	for rows.Next() {
+		link := types.Link{Webring: true}
+		util.Check(rows.Scan(&link.Source, &link.Target))
+		links = append(links, link)
+	}
+	return links
+}
+
+// countRows runs a query selecting a name & a count
+func countRows(db *sql.DB, query string, args ...interface{}) []types.Count {
+	stmt, err := db.Prepare(query)
+	util.Check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	util.Check(err)
+	defer rows.Close()
+
+	var counts []types.Count
+	for rows.Next() {
+		var count types.Count
+		util.Check(rows.Scan(&count.Name, &count.Count))
+		counts = append(counts, count)
+	}
+	return counts
+}
+
+// GetArchivedPage returns the hash of a page's archived copy & the date it was fetched, if there is one
+func GetArchivedPage(db *sql.DB, pageurl string) (types.PageData, bool) {
+	page := types.PageData{URL: pageurl}
+	err := db.QueryRow(`
+    SELECT COALESCE(title, ''), archive_hash, archived FROM pages
+    WHERE url = ? AND archive_hash IS NOT NULL`, pageurl).Scan(&page.Title, &page.ArchiveHash, &page.Archived)
+	if err == sql.ErrNoRows {
+		return page, false
+	}
+	util.Check(err)
+	return page, true
+}
+
 func GetRandomDomain(db *sql.DB) string {
 	rows, err := db.Query("SELECT domain FROM domains ORDER BY RANDOM() LIMIT 1;")
 	util.Check(err)
@@ -228,10 +1007,15 @@ func countQuery(db *sql.DB, table string) int {
 	return count
 }
 
-func SearchWords(db *sql.DB, words []string, searchByScore bool, domain []string, nodomain []string, language []string) []types.PageData {
+// ResultsPerPage is the number of results returned when a query doesn't specify its own limit
+const ResultsPerPage = 15
+
+// searchConditions returns the where clause matching the pages a query is looking for, along with its arguments
+func searchConditions(query types.SearchQuery) (string, []interface{}) {
 	var args []interface{}
 
 	wordlist := []string{"1"}
+	words := append(append([]string{}, query.Words...), query.Synonyms...)
 	if len(words) > 0 && words[0] != "" {
 		wordlist = make([]string, 0)
 		for _, word := range words {
@@ -242,18 +1026,18 @@ func SearchWords(db *sql.DB, words []string, searchByScore bool, domain []string
 
 	// the domains conditional defaults to just 'true' i.e. no domain condition
 	domains := []string{"1"}
-	if len(domain) > 0 && domain[0] != "" {
+	if len(query.Domains) > 0 && query.Domains[0] != "" {
 		domains = make([]string, 0) // we've got at least one domain! clear domains default
-		for _, d := range domain {
+		for _, d := range query.Domains {
 			domains = append(domains, "domain = ?")
 			args = append(args, d)
 		}
 	}
 
 	nodomains := []string{"1"}
-	if len(nodomain) > 0 && nodomain[0] != "" {
+	if len(query.NoDomains) > 0 && query.NoDomains[0] != "" {
 		nodomains = make([]string, 0)
-		for _, d := range nodomain {
+		for _, d := range query.NoDomains {
 			nodomains = append(nodomains, "domain != ?")
 			args = append(args, d)
 		}
@@ -261,9 +1045,9 @@ func SearchWords(db *sql.DB, words []string, searchByScore bool, domain []string
 
 	//This needs some wildcard support …
 	languages := []string{"1"}
-	if len(language) > 0 && language[0] != "" {
+	if len(query.Langs) > 0 && query.Langs[0] != "" {
 		languages = make([]string, 0)
-		for _, d := range language {
+		for _, d := range query.Langs {
 			// Do a little check to avoid the database being DOSed
 			if languageCodeSanityRegex.MatchString(d) {
 				languages = append(languages, "lang LIKE ?")
@@ -272,24 +1056,114 @@ func SearchWords(db *sql.DB, words []string, searchByScore bool, domain []string
 		}
 	}
 
+	// pages linking to any of the given urls or domains, whether inside or outside of the webring
+	links := []string{"1"}
+	if len(query.Links) > 0 {
+		targets := make([]string, 0, len(query.Links))
+		for _, link := range query.Links {
+			condition, linkArgs := linkCondition(link)
+			targets = append(targets, condition)
+			args = append(args, linkArgs...)
+		}
+		links = []string{fmt.Sprintf("p.url IN (SELECT source FROM links WHERE %s)", strings.Join(targets, " OR "))}
+	}
+
+	// pages first seen, or changed, on or after a date
+	dates := []string{"1"}
+	if query.NewSince != "" {
+		dates = append(dates, "p.first_seen >= ?")
+		args = append(args, query.NewSince)
+	}
+	if query.ChangedSince != "" {
+		dates = append(dates, "p.last_changed >= ?")
+		args = append(args, query.ChangedSince)
+	}
+
+	// near-duplicates of another page are never listed
+	conditions := fmt.Sprintf(`(%s)
+    AND (%s)
+    AND (%s)
+    AND (%s)
+    AND (%s)
+    AND (%s)
+    AND (p.duplicate_of IS NULL)`, strings.Join(wordlist, " OR "), strings.Join(domains, " OR "), strings.Join(nodomains, " AND "), strings.Join(languages, " OR "), strings.Join(links, " AND "), strings.Join(dates, " AND "))
+	return conditions, args
+}
+
+// linkCondition matches links to a domain (http://example.org), or to a single page (http://example.org/about)
+// regardless of its protocol. the link is expected in the normal form links are stored in
+func linkCondition(link string) (string, []interface{}) {
+	if u, err := url.Parse(link); err == nil && u.Host != "" && u.Path == "" && u.RawQuery == "" {
+		return "target_domain = ?", []interface{}{strings.ToLower(u.Hostname())}
+	}
+	target := strings.TrimPrefix(strings.TrimPrefix(link, "https://"), "http://")
+	return "target IN (?, ?)", []interface{}{"http://" + target, "https://" + target}
+}
+
+// CountSearchResults returns the total number of pages matching a query, regardless of its limit & offset
+func CountSearchResults(db *sql.DB, query types.SearchQuery) int {
+	conditions, args := searchConditions(query)
+	sqlQuery := fmt.Sprintf(`
+    SELECT COUNT(DISTINCT inv.url)
+    FROM inv_index inv INNER JOIN pages p ON inv.url = p.url 
+    WHERE %s
+    `, conditions)
+
+	stmt, err := db.Prepare(sqlQuery)
+	util.Check(err)
+	defer stmt.Close()
+
+	var count int
+	err = stmt.QueryRow(args...).Scan(&count)
+	util.Check(err)
+	return count
+}
+
+func SearchWords(db *sql.DB, query types.SearchQuery, searchByScore bool, ranking types.Ranking) []types.PageData {
+	// the score is selected before the where clause, so its arguments go first
+	var args []interface{}
 	orderType := "SUM(score)"
 	if !searchByScore {
 		orderType = "COUNT(*)"
+	} else if len(query.Synonyms) > 0 {
+		// matches on synonyms are weighted down, so that pages containing the actual query terms rank higher
+		placeholders := make([]string, 0, len(query.Synonyms))
+		for _, synonym := range query.Synonyms {
+			placeholders = append(placeholders, "?")
+			args = append(args, strings.ToLower(synonym))
+		}
+		orderType = fmt.Sprintf("SUM(CASE WHEN word IN (%s) THEN score * %g ELSE score END)", strings.Join(placeholders, ", "), ranking.Synonyms)
+	}
+	orderType = fmt.Sprintf("%s * %s", orderType, rankingBoosts(ranking))
+
+	order := "rank_score DESC"
+	if query.Newest {
+		order = "p.first_seen DESC, rank_score DESC"
+	} else if ranking.DepthDecay == "strict" {
+		order = "p.depth ASC, rank_score DESC"
 	}
 
-	query := fmt.Sprintf(`
-    SELECT p.url, p.about, p.title, p.depth
+	conditions, conditionArgs := searchConditions(query)
+	args = append(args, conditionArgs...)
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = ResultsPerPage
+	}
+	args = append(args, limit, query.Offset)
+
+	sqlQuery := fmt.Sprintf(`
+    SELECT p.url, p.about, p.title, p.depth, p.lang, COALESCE(p.first_seen, ''), %s AS rank_score,
+        COALESCE((SELECT unreachable_since FROM domains d WHERE d.domain = p.domain), ''), COALESCE(p.archived, ''),
+        COALESCE(p.last_changed, '')
     FROM inv_index inv INNER JOIN pages p ON inv.url = p.url 
-    WHERE (%s)
-    AND (%s)
-    AND (%s)
-    AND (%s)
+    WHERE %s
     GROUP BY inv.url 
-    ORDER BY p.depth ASC, %s DESC
-    LIMIT 15
-    `, strings.Join(wordlist, " OR "), strings.Join(domains, " OR "), strings.Join(nodomains, " AND "), strings.Join(languages, " OR "), orderType)
+    ORDER BY %s
+    LIMIT ? OFFSET ?
+    `, orderType, conditions, order)
 
-	stmt, err := db.Prepare(query)
+	stmt, err := db.Prepare(sqlQuery)
 	util.Check(err)
 	defer stmt.Close()
 
@@ -300,7 +1174,7 @@ func SearchWords(db *sql.DB, words []string, searchByScore bool, domain []string
 	var pageData types.PageData
 	var pages []types.PageData
 	for rows.Next() {
-		if err := rows.Scan(&pageData.URL, &pageData.About, &pageData.Title, &pageData.Depth); err != nil {
+		if err := rows.Scan(&pageData.URL, &pageData.About, &pageData.Title, &pageData.Depth, &pageData.Lang, &pageData.FirstSeen, &pageData.Score, &pageData.Unreachable, &pageData.Archived, &pageData.LastChanged); err != nil {
 			log.Fatalln(err)
 		}
 		pages = append(pages, pageData)
@@ -308,6 +1182,47 @@ func SearchWords(db *sql.DB, words []string, searchByScore bool, domain []string
 	return pages
 }
 
+// the maximum precrawl depth that gets its own decay factor; deeper sites share the factor of this depth
+const maxDecayDepth = 10
+
+// rankingBoosts returns an sql expression multiplied with a page's term score, composed of its depth decay &
+// the freshness, inbound link & authority boosts
+func rankingBoosts(ranking types.Ranking) string {
+	var decay string
+	switch ranking.DepthDecay {
+	case "exponential":
+		// sqlite has no pow() by default, so precompute the factor of each depth
+		cases := make([]string, 0, maxDecayDepth)
+		for depth := 0; depth < maxDecayDepth; depth++ {
+			cases = append(cases, fmt.Sprintf("WHEN %d THEN %g", depth, math.Pow(ranking.DepthFactor, float64(depth))))
+		}
+		decay = fmt.Sprintf("(CASE p.depth %s ELSE %g END)", strings.Join(cases, " "), math.Pow(ranking.DepthFactor, maxDecayDepth))
+	case "hyperbolic":
+		decay = fmt.Sprintf("(1.0 / (1 + %g * p.depth))", ranking.DepthFactor)
+	default:
+		decay = "1"
+	}
+
+	freshness := "1"
+	if ranking.FreshnessBoost > 0 && ranking.FreshnessDays > 0 {
+		// linearly decreasing boost, from freshnessBoost for a page modified today to nothing after freshnessDays
+		freshness = fmt.Sprintf("(1 + %g * COALESCE(MAX(0, 1 - (julianday('now') - julianday(p.modified)) / %d.0), 0))", ranking.FreshnessBoost, ranking.FreshnessDays)
+	}
+
+	inbound := "1"
+	if ranking.InboundBoost > 0 {
+		// approaches the full boost as the number of inbound links grows
+		inbound = fmt.Sprintf("(1 + %g * p.inbound / (p.inbound + 3.0))", ranking.InboundBoost)
+	}
+
+	authority := "1"
+	if ranking.AuthorityBoost > 0 {
+		authority = fmt.Sprintf("(1 + %g * p.authority)", ranking.AuthorityBoost)
+	}
+
+	return fmt.Sprintf("%s * %s * %s * %s", decay, freshness, inbound, authority)
+}
+
 func InsertManyDomains(db *sql.DB, pages []types.PageData) {
 	if len(pages) == 0 {
 		return
@@ -335,14 +1250,21 @@ func InsertManyPages(db *sql.DB, pages []types.PageData) {
 	args := make([]interface{}, 0, len(pages))
 
 	for _, b := range pages {
-		// url, title, lang, about, domain, depth
-		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		// url, title, lang, about, domain, depth, modified, first_seen, archive_hash, archived
+		values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 		u, err := url.Parse(b.URL)
 		util.Check(err)
-		args = append(args, b.URL, b.Title, b.Lang, b.About, u.Hostname(), b.Depth)
+		var modified, archiveHash, archived interface{}
+		if b.Modified != "" {
+			modified = b.Modified
+		}
+		if b.ArchiveHash != "" {
+			archiveHash, archived = b.ArchiveHash, b.Archived
+		}
+		args = append(args, b.URL, b.Title, b.Lang, b.About, u.Hostname(), b.Depth, modified, b.FirstSeen, archiveHash, archived)
 	}
 
-	stmt := fmt.Sprintf(`INSERT OR IGNORE INTO pages(url, title, lang, about, domain, depth) VALUES %s`, strings.Join(values, ","))
+	stmt := fmt.Sprintf(`INSERT OR IGNORE INTO pages(url, title, lang, about, domain, depth, modified, first_seen, archive_hash, archived) VALUES %s`, strings.Join(values, ","))
 	_, err := db.Exec(stmt, args...)
 	util.Check(err)
 }
@@ -366,6 +1288,230 @@ func InsertManyWords(db *sql.DB, batch []types.SearchFragment) {
 	util.Check(err)
 }
 
+// UpdateFoldedWords records the accent-free form of every indexed word that has accents, so that searches can find
+// the accented forms of a folded query term
+func UpdateFoldedWords(db *sql.DB) {
+	rows, err := db.Query("SELECT DISTINCT word FROM inv_index")
+	util.Check(err)
+	folds := make(map[string]string)
+	for rows.Next() {
+		var word string
+		util.Check(rows.Scan(&word))
+		if folded := util.FoldDiacritics(word); folded != word {
+			folds[word] = folded
+		}
+	}
+	util.Check(rows.Err())
+	rows.Close()
+
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO folded_words(word, folded) VALUES (?, ?)")
+	util.Check(err)
+	defer stmt.Close()
+	for word, folded := range folds {
+		_, err = stmt.Exec(word, folded)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+// UnfoldTerms adds the indexed accented forms of the foldable terms, e.g. café for cafe, to the terms
+func UnfoldTerms(db *sql.DB, terms, foldable []string) []string {
+	if len(foldable) == 0 {
+		return terms
+	}
+	stmt, err := db.Prepare("SELECT word FROM folded_words WHERE folded = ?")
+	util.Check(err)
+	defer stmt.Close()
+
+	unfolded := append([]string{}, terms...)
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		seen[term] = true
+	}
+	for _, term := range foldable {
+		rows, err := stmt.Query(term)
+		util.Check(err)
+		for rows.Next() {
+			var word string
+			util.Check(rows.Scan(&word))
+			if !seen[word] {
+				seen[word] = true
+				unfolded = append(unfolded, word)
+			}
+		}
+		rows.Close()
+	}
+	return unfolded
+}
+
+// UpdateInboundCounts stores how many pages of other webring members link to each page
+func UpdateInboundCounts(db *sql.DB) {
+	_, err := db.Exec(`
+    UPDATE pages SET inbound = (
+        SELECT COUNT(DISTINCT source) FROM links
+        WHERE links.target = pages.url AND links.webring = 1 AND links.source_domain != pages.domain
+    )`)
+	util.Check(err)
+}
+
+// GetWebringLinks returns the links between members of the webring, making up the graph authority is computed from
+func GetWebringLinks(db *sql.DB) []types.Link {
+	rows, err := db.Query("SELECT source, target FROM links WHERE webring = 1 AND source_domain != target_domain")
+	util.Check(err)
+	defer rows.Close()
+
+	var links []types.Link
+	for rows.Next() {
+		link := types.Link{Webring: true}
+		util.Check(rows.Scan(&link.Source, &link.Target))
+		links = append(links, link)
+	}
+	return links
+}
+
+// UpdateAuthorityScores stores the authority of each page, scaled so that the most authoritative page has 1
+func UpdateAuthorityScores(db *sql.DB, scores map[string]float64) {
+	var highest float64
+	for _, score := range scores {
+		if score > highest {
+			highest = score
+		}
+	}
+	if highest == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare("UPDATE pages SET authority = ? WHERE url = ?")
+	util.Check(err)
+	defer stmt.Close()
+	for pageurl, score := range scores {
+		_, err = stmt.Exec(score/highest, pageurl)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+// UpdateSimhashes stores the simhash of the text of each page. sqlite has no unsigned integers, so the bits of the
+// hash are stored as a signed one
+func UpdateSimhashes(db *sql.DB, hashes map[string]uint64) {
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare("UPDATE pages SET simhash = ? WHERE url = ?")
+	util.Check(err)
+	defer stmt.Close()
+	for url, hash := range hashes {
+		_, err = stmt.Exec(int64(hash), url)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+// GetSimhashes returns the simhash of every page which has one, for finding near-duplicate pages
+func GetSimhashes(db *sql.DB) []types.Simhash {
+	rows, err := db.Query("SELECT url, domain, simhash, inbound FROM pages WHERE simhash IS NOT NULL")
+	util.Check(err)
+	defer rows.Close()
+
+	var hashes []types.Simhash
+	for rows.Next() {
+		var h types.Simhash
+		var hash int64
+		util.Check(rows.Scan(&h.URL, &h.Domain, &hash, &h.Inbound))
+		h.Hash = uint64(hash)
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+// UpdateDuplicates marks pages as near-duplicates of the page representing them, which hides them from searches
+func UpdateDuplicates(db *sql.DB, duplicates map[string]string) {
+	tx, err := db.Begin()
+	util.Check(err)
+	_, err = tx.Exec("UPDATE pages SET duplicate_of = NULL")
+	util.Check(err)
+	stmt, err := tx.Prepare("UPDATE pages SET duplicate_of = ? WHERE url = ?")
+	util.Check(err)
+	defer stmt.Close()
+	for url, canonical := range duplicates {
+		_, err = stmt.Exec(canonical, url)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
+func InsertManyLinks(db *sql.DB, links []types.Link) {
+	if len(links) == 0 {
+		return
+	}
+	values := make([]string, 0, len(links))
+	args := make([]interface{}, 0, len(links))
+
+	for _, link := range links {
+		source, err := url.Parse(link.Source)
+		util.Check(err)
+		target, err := url.Parse(link.Target)
+		if err != nil {
+			continue
+		}
+		var anchor interface{}
+		if link.Anchor != "" {
+			anchor = link.Anchor
+		}
+		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		args = append(args, link.Source, link.Target, source.Hostname(), target.Hostname(), link.Webring, anchor)
+	}
+	if len(values) == 0 {
+		return
+	}
+
+	stmt := fmt.Sprintf(`INSERT OR IGNORE INTO links(source, target, source_domain, target_domain, webring, anchor) VALUES %s`, strings.Join(values, ","))
+	_, err := db.Exec(stmt, args...)
+	util.Check(err)
+}
+
+// InsertExternalPages describes the pages outside of the webring that members link to. their titles are taken from
+// the text most often used to link to them, unless the crawler fetched the page itself
+func InsertExternalPages(db *sql.DB, fetched map[string]types.ExternalPage) {
+	_, err := db.Exec(`
+    INSERT OR IGNORE INTO external_pages(url, domain, title)
+    SELECT l.target, l.target_domain, (
+        SELECT anchor FROM links a
+        WHERE a.target = l.target AND a.anchor IS NOT NULL
+        GROUP BY anchor ORDER BY COUNT(*) DESC, anchor ASC LIMIT 1
+    )
+    FROM links l WHERE l.webring = 0
+    GROUP BY l.target`)
+	util.Check(err)
+
+	tx, err := db.Begin()
+	util.Check(err)
+	stmt, err := tx.Prepare(`
+    INSERT INTO external_pages(url, domain, title, about) VALUES (?, ?, ?, ?)
+    ON CONFLICT(url) DO UPDATE SET title = COALESCE(excluded.title, title), about = COALESCE(excluded.about, about)`)
+	util.Check(err)
+	defer stmt.Close()
+	for pageurl, page := range fetched {
+		u, err := url.Parse(pageurl)
+		if err != nil {
+			continue
+		}
+		var title, about interface{}
+		if page.Title != "" {
+			title = page.Title
+		}
+		if page.About != "" {
+			about = page.About
+		}
+		_, err = stmt.Exec(pageurl, u.Hostname(), title, about)
+		util.Check(err)
+	}
+	util.Check(tx.Commit())
+}
+
 func InsertManyExternalLinks(db *sql.DB, externalLinks []string) {
 	if len(externalLinks) == 0 {
 		return
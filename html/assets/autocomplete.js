@@ -0,0 +1,25 @@
+// fills the search box's list of suggestions with completions from /suggest while typing
+(function () {
+  const input = document.getElementById("search");
+  const list = document.getElementById("search-suggestions");
+  if (!input || !list) return;
+
+  let timeout;
+  input.addEventListener("input", function () {
+    clearTimeout(timeout);
+    timeout = setTimeout(async function () {
+      const query = input.value;
+      if (query.trim().length < 2) return;
+      const res = await fetch("/suggest?q=" + encodeURIComponent(query));
+      if (!res.ok) return;
+      const [, completions] = await res.json();
+      list.replaceChildren(
+        ...completions.map(function (completion) {
+          const option = document.createElement("option");
+          option.value = completion;
+          return option;
+        })
+      );
+    }, 150);
+  });
+})();
@@ -0,0 +1,51 @@
+package ingest
+
+import (
+	"lieu/types"
+)
+
+// pagerank parameters: the chance of following a link rather than jumping to a random page, and the number of
+// rounds to run. the scores of small link graphs like a webring's converge long before that
+const damping = 0.85
+const pagerankIterations = 30
+
+// computeAuthority runs pagerank over the given links, returning the score of each page taking part in the graph
+func computeAuthority(links []types.Link) map[string]float64 {
+	outgoing := make(map[string][]string)
+	nodes := make(map[string]bool)
+	for _, link := range links {
+		outgoing[link.Source] = append(outgoing[link.Source], link.Target)
+		nodes[link.Source] = true
+		nodes[link.Target] = true
+	}
+	if len(nodes) == 0 {
+		return map[string]float64{}
+	}
+
+	n := float64(len(nodes))
+	scores := make(map[string]float64, len(nodes))
+	for node := range nodes {
+		scores[node] = 1 / n
+	}
+	for i := 0; i < pagerankIterations; i++ {
+		// pages without outgoing links spread their score evenly across all pages
+		var dangling float64
+		for node := range nodes {
+			if len(outgoing[node]) == 0 {
+				dangling += scores[node]
+			}
+		}
+		next := make(map[string]float64, len(nodes))
+		for node := range nodes {
+			next[node] = (1-damping)/n + damping*dangling/n
+		}
+		for source, targets := range outgoing {
+			share := damping * scores[source] / float64(len(targets))
+			for _, target := range targets {
+				next[target] += share
+			}
+		}
+		scores = next
+	}
+	return scores
+}
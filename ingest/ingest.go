@@ -2,10 +2,16 @@ package ingest
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
+	"lieu/crawler"
 	"lieu/database"
 	"lieu/types"
+	"lieu/urlnorm"
 	"lieu/util"
 	"log"
 	"net/url"
@@ -19,6 +25,7 @@ import (
 )
 
 func partitionSentence(s string) []string {
+	s = util.Normalize(s)
 	punctuation := regexp.MustCompile(`\p{P}`)
 	whitespace := regexp.MustCompile(`\p{Z}`)
 	invisible := regexp.MustCompile(`\p{C}`)
@@ -30,14 +37,15 @@ func partitionSentence(s string) []string {
 	s = symbols.ReplaceAllString(s, " ")
 	s = strings.ReplaceAll(s, "|", " ")
 	s = strings.ReplaceAll(s, "/", " ")
-	return strings.Fields(s)
+	return util.SegmentCJK(strings.Fields(s), true)
 }
 
 func filterCommonWords(words, wordlist []string) []string {
 	var filtered []string
 	for _, word := range words {
+		folded := util.FoldDiacritics(word)
 		// ingested word was too common, skip it
-		if len(word) == 1 || find(wordlist, word) {
+		if len(word) == 1 || find(wordlist, word) || find(wordlist, folded) {
 			continue
 		}
 		filtered = append(filtered, inflection.Singular(word))
@@ -61,16 +69,30 @@ func performAboutHeuristic(heuristicPath, phrase string) bool {
 }
 
 func Ingest(config types.Config) {
+	// remember when pages were first seen, before the previous database is replaced
+	var firstSeen = make(map[string]string)
+	// and how often outgoing domains were linked to, for comparing the new crawl with
+	var previousOutgoing = make(map[string]types.OutgoingDomain)
+	var previousCrawl string
+	// the previous database is kept around until the end, for the pages of sites which could not be reached
+	previousDatabase := config.Data.Database + ".previous"
+	var hasPrevious bool
 	if _, err := os.Stat(config.Data.Database); err == nil || os.IsExist(err) {
-		err = os.Remove(config.Data.Database)
+		firstSeen = database.GetFirstSeenDates(config.Data.Database)
+		previousOutgoing, previousCrawl = database.GetOutgoingDomainCounts(config.Data.Database)
+		err = os.Rename(config.Data.Database, previousDatabase)
 		util.Check(err)
+		hasPrevious = true
 	}
 
 	db := database.InitDB(config.Data.Database)
 	date := time.Now().Format("2006-01-02")
 	database.UpdateCrawlDate(db, date)
+	database.InsertPreviousOutgoingDomains(db, previousOutgoing, previousCrawl)
 
 	wordlist := util.ReadList(config.Data.Wordlist, "|")
+	// crawls made before urls were normalized by the crawler may address a page in several ways
+	normalizer := crawler.NewNormalizer(config)
 
 	fmt.Printf("Opening source file: %s\n", config.Data.Source)
 	file, err := os.Open(config.Data.Source)
@@ -97,6 +119,17 @@ func Ingest(config types.Config) {
 	var batchsize = 100
 	batch := make([]types.SearchFragment, 0, 0)
 	var externalLinks []string
+	// links found on each page, along with the page they were found on
+	var pageLinks []types.Link
+	externalPages := make(map[string]types.ExternalPage)
+	// the sites the crawler could not reach, and how crawling each site went
+	var unreachable []string
+	var crawlStats []types.CrawlStats
+	// the fingerprint of each page's contents, for telling when it changed. kept across batches
+	fingerprints := make(map[string]hash.Hash)
+	// and the simhash of each page's text, for finding near-duplicate pages
+	simhashes := make(map[string]*util.Simhash)
+	ranking := config.Ranking
 
 	// Try reading the first line directly to verify content
 	reader := bufio.NewReader(file)
@@ -144,31 +177,53 @@ func Ingest(config types.Config) {
 		}
 		// The second to last part is the URL
 		pageurl := strings.TrimSuffix(parts[len(parts)-2], "/")
+		if normalized, ok := normalizer.Normalize(pageurl); ok {
+			pageurl = normalized
+		}
 		// Everything in between is the content
 		rawdata := strings.Join(parts[1:len(parts)-2], " ")
-		payload := strings.ToLower(rawdata)
+		payload := util.Normalize(rawdata)
 
 		if !strings.HasPrefix(pageurl, "http") {
 			continue
 		}
 
+		if fingerprinted(token) {
+			fingerprint, exists := fingerprints[pageurl]
+			if !exists {
+				fingerprint = sha256.New()
+				fingerprints[pageurl] = fingerprint
+			}
+			io.WriteString(fingerprint, token+" "+rawdata+"\n")
+		}
+		if simhashed(token) {
+			if _, exists := simhashes[pageurl]; !exists {
+				simhashes[pageurl] = &util.Simhash{}
+			}
+			simhashes[pageurl].Add(rawdata)
+		}
+
 		var page types.PageData
 		if data, exists := pages[pageurl]; exists {
 			page = data
 		} else {
 			page.URL = pageurl
 			page.Depth = depth
+			page.FirstSeen = date
+			if seen, exists := firstSeen[pageurl]; exists {
+				page.FirstSeen = seen
+			}
 		}
 
 		var processed []string
-		score := 1
+		score := ranking.Text
 		switch token {
 		case "title":
 			if len(page.About) == 0 {
 				page.About = rawdata
 				page.AboutSource = token
 			}
-			score = 5
+			score = ranking.Title
 			page.Title = rawdata
 			processed = partitionSentence(payload)
 		case "h1":
@@ -180,7 +235,7 @@ func Ingest(config types.Config) {
 		case "h2":
 			fallthrough
 		case "h3":
-			score = 15
+			score = ranking.Heading
 			processed = partitionSentence(payload)
 		case "desc":
 			if len(page.About) < 30 && len(rawdata) < 100 && len(rawdata) > len(page.About) {
@@ -204,8 +259,58 @@ func Ingest(config types.Config) {
 			page.Lang = rawdata
 		case "keywords":
 			processed = strings.Split(strings.ReplaceAll(payload, ", ", ","), ",")
+		case "modified":
+			// keep the most recent of the dates a page reports (e.g. last-modified header & article metadata)
+			if rawdata > page.Modified {
+				page.Modified = rawdata
+			}
+		case "archived":
+			// the hash of the page's archived copy, followed by the date it was fetched
+			if fields := strings.Fields(rawdata); len(fields) == 2 {
+				page.ArchiveHash = fields[0]
+				page.Archived = fields[1]
+			}
 		case "non-webring-link":
-			externalLinks = append(externalLinks, rawdata)
+			link := parseLink(normalizer, pageurl, rawdata, false)
+			externalLinks = append(externalLinks, link.Target)
+			pageLinks = append(pageLinks, link)
+		case "external-title", "external-desc":
+			// written when the crawler visits pages outside of the webring; pageurl is the external page
+			external := externalPages[pageurl]
+			if token == "external-title" {
+				external.Title = rawdata
+			} else if len(external.About) == 0 {
+				external.About = rawdata
+			}
+			externalPages[pageurl] = external
+			continue
+		case "site-status":
+			if rawdata == "unreachable" {
+				if u, err := url.Parse(pageurl); err == nil {
+					unreachable = append(unreachable, u.Hostname())
+				}
+			}
+			continue
+		case "crawl-stats":
+			if u, err := url.Parse(pageurl); err == nil {
+				crawlStats = append(crawlStats, parseCrawlStats(u.Hostname(), rawdata))
+			}
+			continue
+		case "webring-link":
+			link := parseLink(normalizer, pageurl, rawdata, true)
+			if len(link.Anchor) > 0 {
+				// the anchor text describes the linked page, so index it as part of that page
+				for _, word := range filterCommonWords(partitionSentence(link.Anchor), wordlist) {
+					batch = append(batch, types.SearchFragment{Word: word, URL: link.Target, Score: ranking.Anchor})
+					count++
+				}
+			}
+			pageLinks = append(pageLinks, link)
+			continue
+		case "internal-link":
+			// a link between the pages of a single site, stored only so that it gets checked for rot
+			pageLinks = append(pageLinks, parseLink(normalizer, pageurl, rawdata, true))
+			continue
 		default:
 			continue
 		}
@@ -222,26 +327,128 @@ func Ingest(config types.Config) {
 			// we do it here because every page is virtually guaranteed to have a title attr &
 			// it only appears once
 			for _, word := range extractPathSegments(strings.ToLower(pageurl)) {
-				batch = append(batch, types.SearchFragment{Word: word, URL: pageurl, Score: 2})
+				batch = append(batch, types.SearchFragment{Word: word, URL: pageurl, Score: ranking.Path})
 			}
 		}
 
 		if len(pages) > batchsize {
-			ingestBatch(db, batch, pages, externalLinks)
+			ingestBatch(db, batch, pages, externalLinks, pageLinks)
 			externalLinks = make([]string, 0, 0)
+			pageLinks = make([]types.Link, 0, 0)
 			batch = make([]types.SearchFragment, 0, 0)
 			// TODO: make sure we don't partially insert any page data
 			pages = make(map[string]types.PageData)
 		}
 	}
-	ingestBatch(db, batch, pages, externalLinks)
+	ingestBatch(db, batch, pages, externalLinks, pageLinks)
+	pageSimhashes := make(map[string]uint64, len(simhashes))
+	for pageurl, s := range simhashes {
+		if s.Features >= minSimhashFeatures {
+			pageSimhashes[pageurl] = s.Sum()
+		}
+	}
+	database.UpdateSimhashes(db, pageSimhashes)
+	if hasPrevious {
+		database.KeepUnreachableSites(db, previousDatabase, unreachable, date, config.Data.GracePeriod)
+		database.CopyHistory(db, previousDatabase)
+		err = os.Remove(previousDatabase)
+		util.Check(err)
+	}
+	database.InsertCrawlHistory(db, date, crawlStats)
+	pageFingerprints := make(map[string]string, len(fingerprints))
+	for pageurl, fingerprint := range fingerprints {
+		pageFingerprints[pageurl] = hex.EncodeToString(fingerprint.Sum(nil))
+	}
+	// ingests are told apart by the time they were made at, as there may be several on a single day
+	database.InsertPageHistory(db, time.Now().UTC().Format(time.RFC3339), pageFingerprints)
+	database.UpdatePageChanges(db)
+	database.UpdateDomainTags(db, webringTags(config.Crawler.Webring))
+	database.UpdateInboundCounts(db)
+	if config.Data.FoldDiacritics {
+		database.UpdateFoldedWords(db)
+	}
+	duplicates := findDuplicates(database.GetSimhashes(db))
+	database.UpdateDuplicates(db, duplicates)
+	fmt.Printf("hid %d near-duplicate pages\n", len(duplicates))
+	database.UpdateAuthorityScores(db, computeAuthority(database.GetWebringLinks(db)))
+	database.InsertExternalPages(db, externalPages)
 	fmt.Printf("ingested %d words\n", count)
 
 	err = scanner.Err()
 	util.Check(err)
 }
 
-func ingestBatch(db *sql.DB, batch []types.SearchFragment, pageMap map[string]types.PageData, links []string) {
+// fingerprinted reports whether a line of crawled data is part of the page's contents, as opposed to data about the
+// crawl itself (e.g. when the page was fetched) which differs between crawls of an unchanged page
+func fingerprinted(token string) bool {
+	switch token {
+	case "title", "h1", "h2", "h3", "desc", "og-desc", "para", "para-just-p", "lang", "keywords", "webring-link", "non-webring-link":
+		return true
+	}
+	return false
+}
+
+// webringTags collects the tags given to the members of the webring, by domain. members sharing a host, such as the
+// users of a tilde server, share their tags too
+func webringTags(path string) map[string][]string {
+	tags := make(map[string][]string)
+	for _, link := range crawler.ReadWebring(path) {
+		u, err := url.Parse(link.URL)
+		if err != nil {
+			continue
+		}
+		domain := u.Hostname()
+		for _, tag := range link.Tags {
+			if !find(tags[domain], tag) {
+				tags[domain] = append(tags[domain], tag)
+			}
+		}
+	}
+	return tags
+}
+
+// parseLink reads the data of a link line: the link target, optionally followed by the link's anchor text
+func parseLink(normalizer *urlnorm.Normalizer, source, rawdata string, webring bool) types.Link {
+	fields := strings.SplitN(rawdata, " ", 2)
+	link := types.Link{Source: source, Target: strings.TrimSuffix(fields[0], "/"), Webring: webring}
+	if target, ok := normalizer.Normalize(fields[0]); ok {
+		link.Target = target
+	}
+	if len(fields) > 1 {
+		link.Anchor = fields[1]
+	}
+	return link
+}
+
+// parseCrawlStats reads the data of a crawl-stats line, e.g. requests=12 errors=404:3,0:1 median_ms=230 cut_off=long:2
+func parseCrawlStats(domain, rawdata string) types.CrawlStats {
+	stats := types.CrawlStats{Domain: domain}
+	for _, field := range strings.Fields(rawdata) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "requests":
+			stats.Requests, _ = strconv.Atoi(parts[1])
+		case "median_ms":
+			stats.MedianMS, _ = strconv.Atoi(parts[1])
+		case "cut_off":
+			stats.CutOff = parts[1]
+		case "errors":
+			stats.ErrorCodes = parts[1]
+			for _, code := range strings.Split(parts[1], ",") {
+				if count := strings.SplitN(code, ":", 2); len(count) == 2 {
+					n, _ := strconv.Atoi(count[1])
+					stats.Errors += n
+				}
+			}
+		}
+	}
+	return stats
+}
+
+func ingestBatch(db *sql.DB, batch []types.SearchFragment, pageMap map[string]types.PageData, links []string, pageLinks []types.Link) {
 	pages := make([]types.PageData, len(pageMap))
 	i := 0
 	for k := range pageMap {
@@ -260,6 +467,13 @@ func ingestBatch(db *sql.DB, batch []types.SearchFragment, pageMap map[string]ty
 		database.InsertManyWords(db, batch[i:end_i])
 	}
 	database.InsertManyExternalLinks(db, links)
+	for i := 0; i < len(pageLinks); i += 3000 {
+		end_i := i + 3000
+		if end_i > len(pageLinks) {
+			end_i = len(pageLinks)
+		}
+		database.InsertManyLinks(db, pageLinks[i:end_i])
+	}
 	log.Println("finished ingesting batch")
 }
 
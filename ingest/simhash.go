@@ -0,0 +1,93 @@
+package ingest
+
+import (
+	"lieu/types"
+	"math/bits"
+	"sort"
+)
+
+// pages whose simhashes differ in at most this many bits are near-duplicates
+const maxDuplicateDistance = 3
+
+// pages with less text than this many shingles are never considered duplicates. only the title, headings & a single
+// paragraph are hashed, so with any less, posts sharing a template heading & intro would be hidden as duplicates
+const minSimhashFeatures = 20
+
+// simhashed reports whether a line of crawled data is part of the text a page's simhash is made of. links, and the
+// descriptions & keywords which are often the same across a whole site, would make every page of a site look alike
+func simhashed(token string) bool {
+	switch token {
+	case "title", "h1", "h2", "h3", "para", "para-just-p":
+		return true
+	}
+	return false
+}
+
+// findDuplicates groups the pages of each site whose simhashes are close together, and picks a page to represent
+// each group: the one most linked to by other members, or else the one with the shortest url. it returns the page
+// representing each of the other pages
+func findDuplicates(hashes []types.Simhash) map[string]string {
+	// union-find over the indices of hashes
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+
+	// hashes differing in at most 3 bits have at least one of their four 16 bit bands in common, so only pages which
+	// share a band need to be compared
+	type band struct {
+		domain string
+		index  int
+		value  uint64
+	}
+	buckets := make(map[band][]int)
+	for i, h := range hashes {
+		for b := 0; b < 4; b++ {
+			key := band{domain: h.Domain, index: b, value: (h.Hash >> uint(16*b)) & 0xffff}
+			buckets[key] = append(buckets[key], i)
+		}
+	}
+	for _, bucket := range buckets {
+		for x := 0; x < len(bucket); x++ {
+			for y := x + 1; y < len(bucket); y++ {
+				i, j := bucket[x], bucket[y]
+				if bits.OnesCount64(hashes[i].Hash^hashes[j].Hash) <= maxDuplicateDistance {
+					parent[root(i)] = root(j)
+				}
+			}
+		}
+	}
+
+	groups := make(map[int][]int)
+	for i := range hashes {
+		groups[root(i)] = append(groups[root(i)], i)
+	}
+	duplicates := make(map[string]string)
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(x, y int) bool {
+			a, b := hashes[group[x]], hashes[group[y]]
+			if a.Inbound != b.Inbound {
+				return a.Inbound > b.Inbound
+			}
+			if len(a.URL) != len(b.URL) {
+				return len(a.URL) < len(b.URL)
+			}
+			return a.URL < b.URL
+		})
+		canonical := hashes[group[0]].URL
+		for _, i := range group[1:] {
+			duplicates[hashes[i].URL] = canonical
+		}
+	}
+	return duplicates
+}
@@ -0,0 +1,29 @@
+package ingest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lieu/crawler"
+	"lieu/types"
+	"lieu/util"
+	"os"
+	"path/filepath"
+)
+
+// IngestWARC builds the database from the pages archived in the given WARC files, by replaying the crawl they
+// captured & ingesting its output
+func IngestWARC(config types.Config, paths []string) {
+	// the replayed crawl is kept next to the regular crawl output until it has been ingested
+	file, err := ioutil.TempFile(filepath.Dir(config.Data.Source), "replay-*.txt")
+	util.Check(err)
+	defer os.Remove(file.Name())
+
+	fmt.Printf("Replaying the crawl archived in %d warc file(s)\n", len(paths))
+	err = crawler.Replay(config, paths, file)
+	util.Check(err)
+	err = file.Close()
+	util.Check(err)
+
+	config.Data.Source = file.Name()
+	Ingest(config)
+}
@@ -0,0 +1,221 @@
+package linkrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lieu/crawler"
+	"lieu/database"
+	"lieu/types"
+	"lieu/util"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the number of links checked at the same time, and how long to wait for each of them
+const workers = 8
+const timeout = 15 * time.Second
+
+// like the crawler, check at most a few links of the same host at a time, with a delay in between
+const hostParallelism = 2
+const hostDelay = 200 * time.Millisecond
+
+// Check visits every link found during the crawl, both to members of the webring & to pages outside of it, and
+// stores which of them are broken. it then prints a report of the broken links, per site
+func Check(config types.Config) {
+	err := crawler.SetupDefaultProxy(config)
+	util.Check(err)
+	parked := util.ReadList(config.Crawler.ParkedDomains, "\n")
+
+	db := database.InitDB(config.Data.Database)
+	defer db.Close()
+	targets := interleaveHosts(database.GetLinkTargets(db))
+	fmt.Printf("lieu: checking %d links\n", len(targets))
+	hosts := newHostLimiter()
+
+	client := &http.Client{Transport: http.DefaultClient.Transport, Timeout: timeout}
+	jobs := make(chan string)
+	results := make(chan types.LinkStatus)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				host := hostOf(target)
+				hosts.acquire(host)
+				status := checkLink(client, target, parked)
+				hosts.release(host)
+				results <- status
+			}
+		}()
+	}
+	go func() {
+		for _, target := range targets {
+			jobs <- target
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	date := time.Now().Format("2006-01-02")
+	var statuses []types.LinkStatus
+	for status := range results {
+		status.Checked = date
+		statuses = append(statuses, status)
+	}
+	database.UpdateLinkStatuses(db, statuses)
+
+	printReport(database.GetBrokenLinks(db, ""))
+}
+
+// interleaveHosts orders the targets so that consecutive ones are on different hosts, as far as possible, which keeps
+// the workers from all waiting on the same host
+func interleaveHosts(targets []string) []string {
+	var hosts []string
+	byHost := make(map[string][]string)
+	for _, target := range targets {
+		host := hostOf(target)
+		if _, exists := byHost[host]; !exists {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], target)
+	}
+	interleaved := make([]string, 0, len(targets))
+	for len(interleaved) < len(targets) {
+		for _, host := range hosts {
+			if len(byHost[host]) > 0 {
+				interleaved = append(interleaved, byHost[host][0])
+				byHost[host] = byHost[host][1:]
+			}
+		}
+	}
+	return interleaved
+}
+
+func hostOf(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// hostLimiter limits the number of requests made to each host at the same time
+type hostLimiter struct {
+	mutex sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{slots: make(map[string]chan struct{})}
+}
+
+// acquire waits until a request may be made to the host
+func (l *hostLimiter) acquire(host string) {
+	l.mutex.Lock()
+	slots, exists := l.slots[host]
+	if !exists {
+		slots = make(chan struct{}, hostParallelism)
+		l.slots[host] = slots
+	}
+	l.mutex.Unlock()
+	slots <- struct{}{}
+}
+
+// release frees up the host for the next request, after the delay
+func (l *hostLimiter) release(host string) {
+	time.Sleep(hostDelay)
+	l.mutex.Lock()
+	slots := l.slots[host]
+	l.mutex.Unlock()
+	<-slots
+}
+
+// checkLink fetches a link, following redirects, and describes what is wrong with it, if anything
+func checkLink(client *http.Client, target string, parked []string) types.LinkStatus {
+	status := types.LinkStatus{URL: target}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		status.Problem = "invalid"
+		return status
+	}
+	req.Header.Set("User-Agent", "MoldWeb_crawler")
+	res, err := client.Do(req)
+	if err != nil {
+		status.Problem = describeError(err)
+		return status
+	}
+	// only the status is of interest; read a little of the body so the connection can be reused
+	io.CopyN(ioutil.Discard, res.Body, 4096)
+	res.Body.Close()
+
+	status.Status = res.StatusCode
+	if res.Request.URL.String() != target {
+		status.FinalURL = res.Request.URL.String()
+	}
+	host := strings.TrimPrefix(res.Request.URL.Hostname(), "www.")
+	original, err := url.Parse(target)
+	if err == nil && host != strings.TrimPrefix(original.Hostname(), "www.") && isParked(host, parked) {
+		status.Problem = "parked"
+	} else if res.StatusCode >= 400 {
+		status.Problem = fmt.Sprintf("http %d", res.StatusCode)
+	}
+	return status
+}
+
+func describeError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "unreachable"
+	}
+}
+
+// isParked reports whether the host is, or is a subdomain of, one of the domain parking services
+func isParked(host string, parked []string) bool {
+	for _, domain := range parked {
+		domain = strings.TrimSpace(domain)
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func printReport(links []types.BrokenLink) {
+	if len(links) == 0 {
+		fmt.Println("lieu: no broken links found")
+		return
+	}
+	sites := make(map[string][]types.BrokenLink)
+	for _, link := range links {
+		sites[link.Domain] = append(sites[link.Domain], link)
+	}
+	domains := make([]string, 0, len(sites))
+	for domain := range sites {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		fmt.Printf("\n%s (%d broken)\n", domain, len(sites[domain]))
+		for _, link := range sites[domain] {
+			fmt.Printf("  %s\n    -> %s [%s]\n", link.Source, link.Target, link.Problem)
+		}
+	}
+	fmt.Printf("\nlieu: %d broken links on %d sites\n", len(links), len(domains))
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"lieu/database"
+)
+
+// the version of the json api. bump it when making backwards incompatible changes to the responses, and keep
+// serving the previous version under its own prefix for a while
+const apiVersion = 1
+
+// the most results a single api request may ask for using the limit parameter
+const maxAPILimit = 100
+
+type APIResult struct {
+	URL   string  `json:"url"`
+	Title string  `json:"title"`
+	About string  `json:"about"`
+	Lang  string  `json:"lang,omitempty"`
+	Depth int     `json:"depth"`
+	Score float64 `json:"score"`
+	// pages of the webring linking to an outgoing result
+	LinkedFrom []string `json:"linkedFrom,omitempty"`
+	// the date since which the result's site could not be reached, if it could not
+	UnreachableSince string `json:"unreachableSince,omitempty"`
+	// when the page was first seen, and when its contents last changed, if they did
+	FirstSeen   string `json:"firstSeen,omitempty"`
+	LastChanged string `json:"lastChanged,omitempty"`
+}
+
+type APIResponse struct {
+	Version int         `json:"version"`
+	Query   string      `json:"query"`
+	Total   int         `json:"total"`
+	Offset  int         `json:"offset"`
+	Limit   int         `json:"limit"`
+	Took    float64     `json:"took"`
+	Next    string      `json:"next,omitempty"`
+	Prev    string      `json:"prev,omitempty"`
+	Results []APIResult `json:"results"`
+}
+
+type APISite struct {
+	Domain string `json:"domain"`
+	URL    string `json:"url"`
+	Title  string `json:"title"`
+	About  string `json:"about"`
+	Lang   string `json:"lang,omitempty"`
+	Depth  int    `json:"depth"`
+	Pages  int    `json:"pages"`
+	// the date since which the site could not be reached, if it could not
+	UnreachableSince string   `json:"unreachableSince,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+}
+
+type APISitesResponse struct {
+	Version int       `json:"version"`
+	Total   int       `json:"total"`
+	Sites   []APISite `json:"sites"`
+}
+
+type APIError struct {
+	Version int    `json:"version"`
+	Error   string `json:"error"`
+}
+
+func (h RequestHandler) apiSearchRoute(res http.ResponseWriter, req *http.Request) {
+	if !h.handleCORS(res, req) {
+		return
+	}
+	limit := apiLimit(req)
+	search, ok := h.parseSearch(req, limit)
+	if !ok {
+		h.writeAPIError(res, http.StatusBadRequest, "missing or too long query, use the q parameter")
+		return
+	}
+
+	start := time.Now()
+	pages := database.SearchWords(h.db, search.Search, true, h.config.Ranking)
+	total := database.CountSearchResults(h.db, search.Search)
+	offset := search.Search.Offset
+
+	response := APIResponse{
+		Version: apiVersion,
+		Query:   search.Query,
+		Total:   total,
+		Offset:  offset,
+		Limit:   limit,
+		Took:    time.Since(start).Seconds(),
+		Results: make([]APIResult, 0, len(pages)),
+	}
+	for _, page := range pages {
+		response.Results = append(response.Results, APIResult{
+			URL:              page.URL,
+			Title:            page.Title,
+			About:            page.About,
+			Lang:             page.Lang,
+			Depth:            page.Depth,
+			Score:            page.Score,
+			UnreachableSince: page.Unreachable,
+			FirstSeen:        page.FirstSeen,
+			LastChanged:      page.LastChanged,
+		})
+	}
+	if offset > 0 {
+		prevOffset := offset - limit
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		response.Prev = pageLink(req, prevOffset, limit)
+	}
+	if offset+len(pages) < total {
+		response.Next = pageLink(req, offset+len(pages), limit)
+	}
+	h.writeJSON(res, http.StatusOK, response)
+}
+
+func (h RequestHandler) apiOutgoingRoute(res http.ResponseWriter, req *http.Request) {
+	if !h.handleCORS(res, req) {
+		return
+	}
+	query := req.URL.Query().Get("q")
+	if query == "" {
+		h.writeAPIError(res, http.StatusBadRequest, "missing query, use the q parameter")
+		return
+	}
+
+	start := time.Now()
+	pages := database.FulltextSearchWords(h.db, query)
+	response := APIResponse{
+		Version: apiVersion,
+		Query:   query,
+		Total:   len(pages),
+		Limit:   len(pages),
+		Took:    time.Since(start).Seconds(),
+		Results: make([]APIResult, 0, len(pages)),
+	}
+	for _, page := range pages {
+		title := page.Title
+		if title == "" {
+			title = page.URL
+		}
+		response.Results = append(response.Results, APIResult{URL: page.URL, Title: title, About: page.About, LinkedFrom: page.LinkedFrom})
+	}
+	h.writeJSON(res, http.StatusOK, response)
+}
+
+func (h RequestHandler) apiSitesRoute(res http.ResponseWriter, req *http.Request) {
+	if !h.handleCORS(res, req) {
+		return
+	}
+	params := req.URL.Query()
+	sites := database.GetSites(h.db, params.Get("filter"), params.Get("lang"), params.Get("sort"))
+	response := APISitesResponse{Version: apiVersion, Total: len(sites), Sites: make([]APISite, 0, len(sites))}
+	for _, site := range sites {
+		response.Sites = append(response.Sites, APISite{
+			Domain:           site.Domain,
+			URL:              site.URL,
+			Title:            site.Title,
+			About:            site.About,
+			Lang:             site.Lang,
+			Depth:            site.Depth,
+			Pages:            site.Pages,
+			UnreachableSince: site.Unreachable,
+			Tags:             site.Tags,
+		})
+	}
+	h.writeJSON(res, http.StatusOK, response)
+}
+
+// apiLimit returns the number of results requested using the limit parameter, within reason
+func apiLimit(req *http.Request) int {
+	limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return database.ResultsPerPage
+	}
+	if limit > maxAPILimit {
+		return maxAPILimit
+	}
+	return limit
+}
+
+// handleCORS sets the cross-origin headers for the config's allowed origins. it returns false if the request was
+// a preflight request, which has been fully answered
+func (h RequestHandler) handleCORS(res http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	for _, allowed := range h.config.API.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			res.Header().Set("Access-Control-Allow-Origin", allowed)
+			res.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			if allowed != "*" {
+				res.Header().Add("Vary", "Origin")
+			}
+			break
+		}
+	}
+	if req.Method == http.MethodOptions {
+		res.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	return true
+}
+
+func (h RequestHandler) writeAPIError(res http.ResponseWriter, status int, message string) {
+	h.writeJSON(res, status, APIError{Version: apiVersion, Error: message})
+}
+
+func (h RequestHandler) writeJSON(res http.ResponseWriter, status int, data interface{}) {
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(status)
+	encoder := json.NewEncoder(res)
+	encoder.SetEscapeHTML(false)
+	logWriteError(encoder.Encode(data))
+}
+
+// logWriteError notes a failure to write a response. a client going away halfway through is nothing to stop the
+// server over, nor to log
+func logWriteError(err error) {
+	if err == nil || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return
+	}
+	log.Println("failed to write response:", err)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+
+	"lieu/crawler"
+	"lieu/database"
+)
+
+var archiveHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// scripts may not run in archived pages, nor may they redirect or submit forms. images, styles & fonts are still
+// loaded from the original site, if it is still around
+const cachedPolicy = "sandbox; default-src 'none'; img-src * data:; style-src * 'unsafe-inline'; font-src * data:; media-src *"
+
+type CachedData struct {
+	URL      string
+	Title    string
+	Archived string
+}
+
+// cachedRoute serves the archived copy of a page, e.g. /cached?url=https://example.org/about, with a banner on top
+func (h RequestHandler) cachedRoute(res http.ResponseWriter, req *http.Request) {
+	if h.config.Data.Archive == "" {
+		http.NotFound(res, req)
+		return
+	}
+	page, exists := database.GetArchivedPage(h.db, strings.TrimSuffix(req.URL.Query().Get("url"), "/"))
+	if !exists || !archiveHashPattern.MatchString(page.ArchiveHash) {
+		http.NotFound(res, req)
+		return
+	}
+
+	file, err := os.Open(crawler.ArchivePath(h.config.Data.Archive, page.ArchiveHash))
+	if err != nil {
+		http.NotFound(res, req)
+		return
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		cachedError(res, page.URL, err)
+		return
+	}
+	defer zr.Close()
+	doc, err := goquery.NewDocumentFromReader(zr)
+	if err != nil {
+		cachedError(res, page.URL, err)
+		return
+	}
+
+	sanitize(doc)
+	// relative links & images lead to the original site
+	doc.Find("head").PrependHtml(`<base>`)
+	doc.Find("base").SetAttr("href", page.URL)
+
+	var banner bytes.Buffer
+	view := &TemplateView{SiteName: h.config.General.Name, Data: CachedData{URL: page.URL, Title: page.Title, Archived: page.Archived}}
+	if err = templates.ExecuteTemplate(&banner, "cached.html", view); err != nil {
+		cachedError(res, page.URL, err)
+		return
+	}
+	doc.Find("body").PrependHtml(banner.String())
+
+	html, err := doc.Html()
+	if err != nil {
+		cachedError(res, page.URL, err)
+		return
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Content-Security-Policy", cachedPolicy)
+	res.Header().Set("X-Robots-Tag", "noindex")
+	res.Write([]byte(html))
+}
+
+// cachedError answers that the archived copy of a page could not be shown, e.g. because its file is corrupt
+func cachedError(res http.ResponseWriter, pageURL string, err error) {
+	log.Println("failed to serve the archived copy of", pageURL, err)
+	http.Error(res, "The archived copy of this page could not be read", http.StatusInternalServerError)
+}
+
+// sanitize removes everything from an archived page that could run code, or take the reader elsewhere on its own
+func sanitize(doc *goquery.Document) {
+	doc.Find("script, iframe, frame, frameset, object, embed, applet, base, meta[http-equiv]").Remove()
+	doc.Find("*").Each(func(_ int, s *goquery.Selection) {
+		for _, node := range s.Nodes {
+			attrs := node.Attr[:0]
+			for _, attr := range node.Attr {
+				name := strings.ToLower(attr.Key)
+				value := strings.ToLower(strings.TrimSpace(attr.Val))
+				if strings.HasPrefix(name, "on") || strings.HasPrefix(value, "javascript:") || strings.HasPrefix(value, "vbscript:") {
+					continue
+				}
+				attrs = append(attrs, attr)
+			}
+			node.Attr = attrs
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"lieu/database"
+	"lieu/types"
+)
+
+// the number of most recent crawls charted on the health page
+const healthRuns = 30
+
+type HealthData struct {
+	Title string
+	Runs  []string
+	Sites []HealthSite
+}
+
+// HealthSite is the crawl history of a single member, with one point for each crawl in HealthData.Runs
+type HealthSite struct {
+	Domain     string
+	Latest     types.CrawlStats
+	ErrorRate  int
+	Struggling bool
+	History    []HealthPoint
+}
+
+type HealthPoint struct {
+	types.CrawlStats
+	// whether the site was part of the crawl at all
+	Crawled bool
+	// the number of pages indexed, as a percentage of the most pages indexed for the site in any crawl
+	Height    int
+	ErrorRate int
+}
+
+// errorRate is the percentage of requests which failed
+func errorRate(stats types.CrawlStats) int {
+	if stats.Requests == 0 {
+		return 0
+	}
+	return stats.Errors * 100 / stats.Requests
+}
+
+// healthRoute charts how crawling each member went across the most recent crawls, listing the members who seem to be
+// struggling first
+func (h RequestHandler) healthRoute(res http.ResponseWriter, req *http.Request) {
+	view := &TemplateView{}
+	history := database.GetCrawlHistory(h.db, healthRuns)
+
+	runSet := make(map[string]bool)
+	bySite := make(map[string]map[string]types.CrawlStats)
+	for _, stats := range history {
+		runSet[stats.Run] = true
+		if _, exists := bySite[stats.Domain]; !exists {
+			bySite[stats.Domain] = make(map[string]types.CrawlStats)
+		}
+		bySite[stats.Domain][stats.Run] = stats
+	}
+	runs := make([]string, 0, len(runSet))
+	for run := range runSet {
+		runs = append(runs, run)
+	}
+	sort.Strings(runs)
+
+	sites := make([]HealthSite, 0, len(bySite))
+	for domain, siteRuns := range bySite {
+		site := HealthSite{Domain: domain}
+		var mostPages int
+		for _, stats := range siteRuns {
+			if stats.Pages > mostPages {
+				mostPages = stats.Pages
+			}
+		}
+		for _, run := range runs {
+			stats, crawled := siteRuns[run]
+			point := HealthPoint{CrawlStats: stats, Crawled: crawled, ErrorRate: errorRate(stats)}
+			if mostPages > 0 {
+				point.Height = stats.Pages * 100 / mostPages
+			}
+			site.History = append(site.History, point)
+		}
+		latest, crawled := siteRuns[runs[len(runs)-1]]
+		site.Latest = latest
+		site.ErrorRate = errorRate(latest)
+		// missing from the latest crawl, nothing indexed, or most requests failing
+		site.Struggling = !crawled || latest.Pages == 0 || site.ErrorRate >= 50
+		sites = append(sites, site)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].Struggling != sites[j].Struggling {
+			return sites[i].Struggling
+		}
+		if sites[i].ErrorRate != sites[j].ErrorRate {
+			return sites[i].ErrorRate > sites[j].ErrorRate
+		}
+		return sites[i].Domain < sites[j].Domain
+	})
+
+	view.Data = HealthData{Title: "Health", Runs: runs, Sites: sites}
+	h.renderView(res, "health", view)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"lieu/database"
+	"lieu/types"
+)
+
+type HistoryData struct {
+	Title   string
+	Page    types.PageData
+	History []types.PageSnapshot
+	// the average number of days between changes, over the period the page has been seen in; 0 if it never changed
+	Interval int
+}
+
+// historyRoute lists when a page was seen, and whether its contents had changed since the time before, e.g.
+// /history?url=https://example.org/about
+func (h RequestHandler) historyRoute(res http.ResponseWriter, req *http.Request) {
+	page, history, exists := database.GetPageHistory(h.db, strings.TrimSuffix(req.URL.Query().Get("url"), "/"))
+	if !exists {
+		http.NotFound(res, req)
+		return
+	}
+	data := HistoryData{Title: "History", Page: page, History: history}
+	if page.Changes > 0 && len(history) > 1 {
+		first, err1 := time.Parse("2006-01-02", runDate(history[len(history)-1].Run))
+		last, err2 := time.Parse("2006-01-02", runDate(history[0].Run))
+		if err1 == nil && err2 == nil {
+			data.Interval = int(last.Sub(first).Hours()/24) / page.Changes
+		}
+	}
+	for i := range history {
+		if len(history[i].Fingerprint) > 12 {
+			history[i].Fingerprint = history[i].Fingerprint[:12]
+		}
+		if run, err := time.Parse(time.RFC3339, history[i].Run); err == nil {
+			history[i].Run = run.Format("2006-01-02 15:04 UTC")
+		}
+	}
+	h.renderView(res, "history", &TemplateView{Data: data})
+}
+
+// runDate returns the date of a run, which is identified by the time of its ingest or, in older databases, its date
+func runDate(run string) string {
+	if len(run) > len("2006-01-02") {
+		return run[:len("2006-01-02")]
+	}
+	return run
+}
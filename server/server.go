@@ -2,28 +2,39 @@ package server
 
 import (
 	"database/sql"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"html/template"
+	"lieu/crawler"
 	"lieu/database"
 	"lieu/types"
+	"lieu/urlnorm"
 	"lieu/util"
 )
 
 type RequestHandler struct {
-	config types.Config
-	db     *sql.DB
+	config     types.Config
+	db         *sql.DB
+	synonyms   map[string][]string
+	normalizer *urlnorm.Normalizer
 }
 
 type TemplateView struct {
-	SiteName string
-	Data     interface{}
+	SiteName     string
+	Autocomplete bool
+	Data         interface{}
 }
 
 type SearchData struct {
@@ -32,6 +43,14 @@ type SearchData struct {
 	Site       string
 	Pages      []types.PageData
 	IsInternal bool
+	// pagination: the total number of results, the range shown on this page & links to its neighbours
+	Total    int
+	From     int
+	To       int
+	Duration string
+	PrevLink string
+	NextLink string
+	FeedLink string
 }
 
 type IndexData struct {
@@ -39,6 +58,64 @@ type IndexData struct {
 	Placeholder string
 }
 
+type FeedData struct {
+	Query     string
+	Self      string
+	Alternate string
+	Updated   string
+	Entries   []FeedEntry
+}
+
+type FeedEntry struct {
+	URL       string
+	Domain    string
+	Title     string
+	About     string
+	Published string
+}
+
+type SitesData struct {
+	Title    string
+	Filter   string
+	Lang     string
+	Sort     string
+	Domains  []types.SiteData
+	JSONLink string
+}
+
+type SiteProfileData struct {
+	Title       string
+	Site        types.SiteData
+	LastCrawl   string
+	Languages   []types.Count
+	Terms       []types.Count
+	LinkedPages []types.PageData
+	Inbound     []types.Link
+	Outgoing    []types.Count
+}
+
+type OutgoingDomainsData struct {
+	Title         string
+	PreviousCrawl string
+	Domains       []types.OutgoingDomain
+	// the domain drilled down into, and the links to it
+	Domain string
+	Links  []types.Link
+}
+
+type LinkrotData struct {
+	Title string
+	// the number of broken links per site, or the broken links of the site given by the site parameter
+	Sites  []types.Count
+	Site   string
+	Broken []types.BrokenLink
+}
+
+type OpenSearchData struct {
+	URL     string
+	Tagline string
+}
+
 type ListData struct {
 	Title string
 	URLs  []types.PageData
@@ -54,21 +131,64 @@ type AboutData struct {
 	RingLink     string
 }
 
-var templates = template.Must(template.ParseFiles(
+var templateFiles = []string{
 	"html/head.html", "html/nav.html", "html/footer.html",
-	"html/about.html", "html/index.html", "html/list.html", "html/search.html", "html/webring.html"))
+	"html/about.html", "html/index.html", "html/list.html", "html/search.html", "html/webring.html",
+	"html/site.html", "html/outgoing-domains.html", "html/linkrot.html",
+	"html/health.html", "html/cached.html", "html/history.html",
+	"html/opensearch.xml", "html/atom.xml"}
+
+var templates = template.Must(template.ParseFiles(templateFiles...))
 
 const useURLTitles = true
 
-func (h RequestHandler) searchRoute(res http.ResponseWriter, req *http.Request) {
+const maxSuggestions = 8
+
+// the number of pages listed in a search's feed
+const feedSize = 30
+
+// the number of entries shown in each section of a site's profile
+const profileSize = 20
+
+// the number of domains on the outgoing domains leaderboard, and of links listed for a single domain
+const leaderboardSize = 100
+const domainLinksSize = 200
+
+// searchRequest is a search, as parsed from the parameters of a request
+type searchRequest struct {
+	// the query as typed, including any operators
+	Query string
+	// the domain passed using the site parameter
+	Site   string
+	Search types.SearchQuery
+}
+
+// normalizeLink rewrites the argument of link: to the form links were stored in, e.g. example.org/about/index.html
+// to https://example.org/about. arguments which aren't a url are kept as they are, and match nothing
+func (h RequestHandler) normalizeLink(link string) string {
+	rawurl := link
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "http://" + rawurl
+	}
+	if normalized, ok := h.normalizer.Normalize(rawurl); ok {
+		return normalized
+	}
+	return link
+}
+
+// parseSearch reads the query & operators of a search from a request's parameters. it returns false if there is
+// nothing to search for, or if the query is unreasonably large
+func (h RequestHandler) parseSearch(req *http.Request, limit int) (searchRequest, bool) {
 	var query string
 	var domain string
-	view := &TemplateView{}
 
 	var domains = []string{}
 	var nodomains = []string{}
 	var langs = []string{}
+	var links = []string{}
+	var newSince, changedSince string
 	var queryFields = []string{}
+	var offset int
 		
 	if req.Method == http.MethodGet{
 		params := req.URL.Query()
@@ -77,6 +197,18 @@ func (h RequestHandler) searchRoute(res http.ResponseWriter, req *http.Request)
 			queryFields = strings.Fields(query)
 		}
 
+		// results are paginated either by page number (starting at 1) or by an offset into the results
+		if parts, exists := params["page"]; exists {
+			if page, err := strconv.Atoi(parts[0]); err == nil && page > 1 {
+				offset = (page - 1) * limit
+			}
+		}
+		if parts, exists := params["offset"]; exists {
+			if n, err := strconv.Atoi(parts[0]); err == nil && n > 0 {
+				offset = n
+			}
+		}
+
 		// how to use: https://gist.github.com/cblgh/29991ba0a9e65cccbe14f4afd7c975f1
 		if parts, exists := params["site"]; exists && parts[0] != "" {
 			// make sure we only have the domain, and no protocol prefix
@@ -97,6 +229,12 @@ func (h RequestHandler) searchRoute(res http.ResponseWriter, req *http.Request)
 					nodomains = append(nodomains, strings.TrimPrefix(word, "-site:"))
 				} else if strings.HasPrefix(word, "lang:") {
 					langs = append(langs, strings.TrimPrefix(word, "lang:"))
+				} else if strings.HasPrefix(word, "link:") && len(word) > len("link:") {
+					links = append(links, h.normalizeLink(strings.TrimPrefix(word, "link:")))
+				} else if since, ok := sinceDate(word, "new:"); ok {
+					newSince = since
+				} else if since, ok := sinceDate(word, "changed:"); ok {
+					changedSince = since
 				} else {
 					newQueryFields = append(newQueryFields, word)
 				}
@@ -106,13 +244,72 @@ func (h RequestHandler) searchRoute(res http.ResponseWriter, req *http.Request)
 		
 	}
 
-	if len(queryFields) == 0 || len(queryFields) > 100 || len(query) >= 8192 {
+	// a search for backlinks, or for new or changed pages, needs no other terms
+	filtered := len(links) > 0 || newSince != "" || changedSince != ""
+	if (len(queryFields) == 0 && !filtered) || len(queryFields) > 100 || len(query) >= 8192 {
+		return searchRequest{Query: query, Site: domain}, false
+	}
+
+	terms, foldable := util.QueryTerms(queryFields, h.config.Data.FoldDiacritics)
+	synonyms := util.ExpandSynonyms(terms, h.synonyms)
+	if h.config.Data.FoldDiacritics {
+		// synonyms are folded, so any accented form of them matches too
+		synonyms = database.UnfoldTerms(h.db, synonyms, synonyms)
+	}
+	return searchRequest{
+		Query: query,
+		Site:  domain,
+		Search: types.SearchQuery{
+			Words:     database.UnfoldTerms(h.db, terms, foldable),
+			Synonyms:  synonyms,
+			Domains:   domains,
+			NoDomains: nodomains,
+			Langs:     langs,
+			Links:     links,
+			Limit:     limit,
+			Offset:    offset,
+
+			NewSince:     newSince,
+			ChangedSince: changedSince,
+		},
+	}, true
+}
+
+// sinceDate reads the date of a new: or changed: operator, given either as a number of days ago (new:7) or as a
+// date (new:2024-05-01)
+func sinceDate(word, operator string) (string, bool) {
+	if !strings.HasPrefix(word, operator) {
+		return "", false
+	}
+	value := strings.TrimPrefix(word, operator)
+	if days, err := strconv.Atoi(value); err == nil && days >= 0 {
+		return time.Now().AddDate(0, 0, -days).Format("2006-01-02"), true
+	}
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date.Format("2006-01-02"), true
+	}
+	return "", false
+}
+
+func (h RequestHandler) searchRoute(res http.ResponseWriter, req *http.Request) {
+	view := &TemplateView{}
+
+	search, ok := h.parseSearch(req, database.ResultsPerPage)
+	if !ok {
 		view.Data = IndexData{Tagline: h.config.General.Tagline, Placeholder: h.config.General.Placeholder}
 		h.renderView(res, "index", view)
 		return
 	}
+	if req.URL.Query().Get("format") == "atom" {
+		h.feed(res, req, search)
+		return
+	}
 
-	var pages = database.SearchWords(h.db, util.Inflect(queryFields), true, domains, nodomains, langs)
+	start := time.Now()
+	var pages = database.SearchWords(h.db, search.Search, true, h.config.Ranking)
+	total := database.CountSearchResults(h.db, search.Search)
+	duration := time.Since(start)
+	offset := search.Search.Offset
 
 	if useURLTitles {
 		for i, pageData := range pages {
@@ -123,16 +320,61 @@ func (h RequestHandler) searchRoute(res http.ResponseWriter, req *http.Request)
 		}
 	}
 
-	view.Data = SearchData{
+	data := SearchData{
 		Title:      "Results",
-		Query:      query,
-		Site:       domain,
+		Query:      search.Query,
+		Site:       search.Site,
 		Pages:      pages,
 		IsInternal: true,
+		Total:      total,
+		From:       offset + 1,
+		To:         offset + len(pages),
+		Duration:   fmt.Sprintf("%.3f", duration.Seconds()),
+		FeedLink:   feedLink(req),
+	}
+	if offset > 0 {
+		prevOffset := offset - database.ResultsPerPage
+		if prevOffset >= total {
+			// past the last page, e.g. after following an old link: go back to the last page instead
+			prevOffset = (total - 1) / database.ResultsPerPage * database.ResultsPerPage
+		}
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		data.PrevLink = pageLink(req, prevOffset, database.ResultsPerPage)
 	}
+	if offset+len(pages) < total {
+		data.NextLink = pageLink(req, offset+len(pages), database.ResultsPerPage)
+	}
+	view.Data = data
 	h.renderView(res, "search", view)
 }
 
+// feedLink returns the url of the atom feed for the current search
+func feedLink(req *http.Request) string {
+	params := req.URL.Query()
+	params.Del("offset")
+	params.Del("page")
+	params.Set("format", "atom")
+	return fmt.Sprintf("%s?%s", req.URL.Path, params.Encode())
+}
+
+// pageLink returns the url of the current search, with the results starting at the given offset. the query
+// string is otherwise kept as-is, preserving the site parameter & any operators
+func pageLink(req *http.Request, offset, limit int) string {
+	params := req.URL.Query()
+	params.Del("offset")
+	params.Del("page")
+	if offset%limit == 0 {
+		if page := offset/limit + 1; page > 1 {
+			params.Set("page", strconv.Itoa(page))
+		}
+	} else {
+		params.Set("offset", strconv.Itoa(offset))
+	}
+	return fmt.Sprintf("%s?%s", req.URL.Path, params.Encode())
+}
+
 func (h RequestHandler) externalSearchRoute(res http.ResponseWriter, req *http.Request) {
 	var query string
 	view := &TemplateView{}
@@ -146,8 +388,9 @@ func (h RequestHandler) externalSearchRoute(res http.ResponseWriter, req *http.R
 
 	pages := database.FulltextSearchWords(h.db, query)
 
-	if useURLTitles {
-		for i, pageData := range pages {
+	// outgoing pages without a title, as given by the links to them, are shown by their url
+	for i, pageData := range pages {
+		if pageData.Title == "" {
 			prettyURL, err := url.QueryUnescape(strings.TrimPrefix(strings.TrimPrefix(pageData.URL, "http://"), "https://"))
 			util.Check(err)
 			pageData.Title = prettyURL
@@ -164,6 +407,37 @@ func (h RequestHandler) externalSearchRoute(res http.ResponseWriter, req *http.R
 	h.renderView(res, "search", view)
 }
 
+// outgoingDomainsRoute lists the domains outside of the webring that members link to the most. given the domain
+// parameter, it lists the links to that domain instead
+func (h RequestHandler) outgoingDomainsRoute(res http.ResponseWriter, req *http.Request) {
+	view := &TemplateView{}
+	data := OutgoingDomainsData{Title: "Outgoing domains", PreviousCrawl: database.GetPreviousCrawl(h.db)}
+	if domain := strings.ToLower(req.URL.Query().Get("domain")); domain != "" {
+		data.Title = fmt.Sprintf("Links to %s", domain)
+		data.Domain = domain
+		data.Links = database.GetOutgoingLinks(h.db, domain, domainLinksSize)
+	} else {
+		data.Domains = database.GetOutgoingDomains(h.db, leaderboardSize)
+	}
+	view.Data = data
+	h.renderView(res, "outgoing-domains", view)
+}
+
+// linkrotRoute reports the broken links found by `lieu linkrot`, per site
+func (h RequestHandler) linkrotRoute(res http.ResponseWriter, req *http.Request) {
+	view := &TemplateView{}
+	data := LinkrotData{Title: "Link rot"}
+	if site := strings.ToLower(req.URL.Query().Get("site")); site != "" {
+		data.Title = fmt.Sprintf("Link rot on %s", site)
+		data.Site = site
+		data.Broken = database.GetBrokenLinks(h.db, site)
+	} else {
+		data.Sites = database.GetBrokenLinkCounts(h.db)
+	}
+	view.Data = data
+	h.renderView(res, "linkrot", view)
+}
+
 func (h RequestHandler) aboutRoute(res http.ResponseWriter, req *http.Request) {
 	view := &TemplateView{}
 
@@ -215,20 +489,164 @@ func (h RequestHandler) randomExternalRoute(res http.ResponseWriter, req *http.R
 	http.Redirect(res, req, link, http.StatusSeeOther)
 }
 
+// suggestRoute answers with completions of the query in the opensearch suggestions format:
+// [query, [completions]]
+func (h RequestHandler) suggestRoute(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query().Get("q")
+	completions := make([]string, 0, maxSuggestions)
+	if len(query) > 0 && len(query) < 200 {
+		// complete the last word of the query using the index' terms, keeping the words typed before it
+		fields := strings.Fields(util.Normalize(query))
+		if len(fields) > 0 && !strings.HasSuffix(query, " ") {
+			preceding := strings.Join(fields[:len(fields)-1], " ")
+			for _, term := range database.SuggestTerms(h.db, fields[len(fields)-1], maxSuggestions) {
+				completions = append(completions, strings.TrimSpace(preceding+" "+term))
+			}
+		}
+		for _, title := range database.SuggestTitles(h.db, query, maxSuggestions-len(completions)) {
+			completions = append(completions, title)
+		}
+	}
+	res.Header().Set("Content-Type", "application/x-suggestions+json")
+	logWriteError(json.NewEncoder(res).Encode([]interface{}{query, util.DeduplicateSlice(completions)}))
+}
+
+func (h RequestHandler) openSearchRoute(res http.ResponseWriter, req *http.Request) {
+	view := &TemplateView{}
+	view.Data = OpenSearchData{URL: h.baseURL(req), Tagline: h.config.General.Tagline}
+	res.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	h.renderView(res, "opensearch.xml", view)
+}
+
+// baseURL returns the address this instance is reachable at, without a trailing slash
+func (h RequestHandler) baseURL(req *http.Request) string {
+	base := h.config.General.PublicURL
+	if base == "" {
+		// no public url configured, assume we're reachable the way this request reached us
+		scheme := "http"
+		if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = fmt.Sprintf("%s://%s", scheme, req.Host)
+	}
+	return strings.TrimSuffix(base, "/")
+}
+
+// feed renders the most recently discovered pages matching a search as an atom feed
+func (h RequestHandler) feed(res http.ResponseWriter, req *http.Request, search searchRequest) {
+	view := &TemplateView{}
+	search.Search.Limit = feedSize
+	search.Search.Offset = 0
+	search.Search.Newest = true
+	pages := database.SearchWords(h.db, search.Search, true, h.config.Ranking)
+
+	base := h.baseURL(req)
+	params := req.URL.Query()
+	params.Del("page")
+	params.Del("offset")
+	data := FeedData{
+		Query:   search.Query,
+		Self:    fmt.Sprintf("%s/?%s", base, params.Encode()),
+		Updated: atomDate(database.GetLastCrawl(h.db)),
+		Entries: make([]FeedEntry, 0, len(pages)),
+	}
+	params.Del("format")
+	data.Alternate = fmt.Sprintf("%s/?%s", base, params.Encode())
+	for _, page := range pages {
+		u, err := url.Parse(page.URL)
+		if err != nil {
+			log.Println("leaving out of feed:", err)
+			continue
+		}
+		data.Entries = append(data.Entries, FeedEntry{
+			URL:       page.URL,
+			Domain:    u.Hostname(),
+			Title:     page.Title,
+			About:     page.About,
+			Published: atomDate(page.FirstSeen),
+		})
+	}
+	view.Data = data
+	res.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	// html/template would escape the xml declaration, so it's written separately
+	if _, err := res.Write([]byte(xml.Header)); err != nil {
+		logWriteError(err)
+		return
+	}
+	h.renderView(res, "atom.xml", view)
+}
+
+// atomDate converts the dates lieu stores (2006-01-02) into the timestamps atom feeds use
+func atomDate(date string) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		t = time.Now()
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// sitesRoute lists the members of the webring. the list can be narrowed down using the filter & lang parameters,
+// and ordered using sort (name, pages or depth)
+func (h RequestHandler) sitesRoute(res http.ResponseWriter, req *http.Request) {
+	view := &TemplateView{}
+	params := req.URL.Query()
+	if params.Get("format") == "json" {
+		h.apiSitesRoute(res, req)
+		return
+	}
+	sites := database.GetSites(h.db, params.Get("filter"), params.Get("lang"), params.Get("sort"))
+	params.Set("format", "json")
+	view.Data = SitesData{
+		Title:    "Sites",
+		Filter:   params.Get("filter"),
+		Lang:     params.Get("lang"),
+		Sort:     params.Get("sort"),
+		Domains:  sites,
+		JSONLink: fmt.Sprintf("%s?%s", req.URL.Path, params.Encode()),
+	}
+	h.renderView(res, "webring", view)
+}
+
+// siteRoute shows what the index knows about a single member of the webring, e.g. /site/example.org
+func (h RequestHandler) siteRoute(res http.ResponseWriter, req *http.Request) {
+	view := &TemplateView{}
+	domain := strings.ToLower(strings.Trim(strings.TrimPrefix(req.URL.Path, "/site/"), "/"))
+	site, exists := database.GetSite(h.db, domain)
+	if !exists {
+		http.NotFound(res, req)
+		return
+	}
+	view.Data = SiteProfileData{
+		Title:       site.Domain,
+		Site:        site,
+		LastCrawl:   database.GetLastCrawl(h.db),
+		Languages:   database.GetSiteLanguages(h.db, domain),
+		Terms:       database.GetSiteTopTerms(h.db, domain, profileSize),
+		LinkedPages: database.GetMostLinkedPages(h.db, domain, profileSize),
+		Inbound:     database.GetInboundLinks(h.db, domain, profileSize),
+		Outgoing:    database.GetSiteOutgoingDomains(h.db, domain, profileSize),
+	}
+	h.renderView(res, "site", view)
+}
+
 func (h RequestHandler) webringRoute(res http.ResponseWriter, req *http.Request) {
 	http.Redirect(res, req, h.config.General.URL, http.StatusSeeOther)
 }
 
 func (h RequestHandler) renderView(res http.ResponseWriter, tmpl string, view *TemplateView) {
 	view.SiteName = h.config.General.Name
+	view.Autocomplete = h.config.General.Autocomplete
+	// templates are html, unless their name says otherwise
+	name := tmpl
+	if filepath.Ext(tmpl) == "" {
+		name = tmpl + ".html"
+	}
 	var errTemp error
 	if _, exists := os.LookupEnv("LIEU_DEV"); exists {
-		var templates = template.Must(template.ParseFiles(
-			"html/head.html", "html/nav.html", "html/footer.html",
-			"html/about.html", "html/index.html", "html/list.html", "html/search.html", "html/webring.html"))
-		errTemp = templates.ExecuteTemplate(res, tmpl+".html", view)
+		var templates = template.Must(template.ParseFiles(templateFiles...))
+		errTemp = templates.ExecuteTemplate(res, name, view)
 	} else {
-		errTemp = templates.ExecuteTemplate(res, tmpl+".html", view)
+		errTemp = templates.ExecuteTemplate(res, name, view)
 	}
 	if errors.Is(errTemp, syscall.EPIPE) {
 		fmt.Println("had a broken pipe, continuing")
@@ -256,15 +674,32 @@ func WriteTheme(config types.Config) {
 func Serve(config types.Config) {
 	WriteTheme(config)
 	db := database.InitDB(config.Data.Database)
-	handler := RequestHandler{config: config, db: db}
+	synonyms := util.ReadSynonyms(config.Data.Synonyms, config.Data.FoldDiacritics)
+	handler := RequestHandler{config: config, db: db, synonyms: synonyms, normalizer: crawler.NewNormalizer(config)}
 
 	http.HandleFunc("/about", handler.aboutRoute)
 	http.HandleFunc("/", handler.searchRoute)
 	http.HandleFunc("/outgoing", handler.externalSearchRoute)
+	http.HandleFunc("/outgoing/domains", handler.outgoingDomainsRoute)
 	http.HandleFunc("/random/outgoing", handler.randomExternalRoute)
 	http.HandleFunc("/random", handler.randomRoute)
 	http.HandleFunc("/webring", handler.webringRoute)
+	http.HandleFunc("/sites", handler.sitesRoute)
+	http.HandleFunc("/site/", handler.siteRoute)
 	http.HandleFunc("/filtered", handler.filteredRoute)
+	http.HandleFunc("/linkrot", handler.linkrotRoute)
+	http.HandleFunc("/health", handler.healthRoute)
+	http.HandleFunc("/cached", handler.cachedRoute)
+	http.HandleFunc("/history", handler.historyRoute)
+	http.HandleFunc("/suggest", handler.suggestRoute)
+	http.HandleFunc("/opensearch.xml", handler.openSearchRoute)
+	http.HandleFunc("/api/v1/search", handler.apiSearchRoute)
+	http.HandleFunc("/api/v1/outgoing", handler.apiOutgoingRoute)
+	http.HandleFunc("/api/v1/sites", handler.apiSitesRoute)
+	// unversioned aliases, always pointing at the current version of the api
+	http.HandleFunc("/api/search", handler.apiSearchRoute)
+	http.HandleFunc("/api/outgoing", handler.apiOutgoingRoute)
+	http.HandleFunc("/api/sites", handler.apiSitesRoute)
 
 	fileserver := http.FileServer(http.Dir("html/"))
 	http.Handle("/assets/", fileserver)
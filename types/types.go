@@ -6,6 +6,34 @@ type SearchFragment struct {
 	Score int
 }
 
+// SearchQuery holds the terms & operators of a search, as parsed from a query string
+type SearchQuery struct {
+	Words []string
+	// terms related to Words through the synonyms file, which contribute less to a page's score
+	Synonyms  []string
+	Domains   []string
+	NoDomains []string
+	Langs     []string
+	// urls or domains the matching pages have to link to
+	Links []string
+	// pagination of the results; a limit of 0 uses the default number of results
+	Limit  int
+	Offset int
+	// list the most recently discovered pages first, instead of the highest scoring ones
+	Newest bool
+	// only pages first seen, or whose contents changed, on or after these dates
+	NewSince     string
+	ChangedSince string
+}
+
+// PageSnapshot is the fingerprint of a page's contents as of a single ingest
+type PageSnapshot struct {
+	Run         string
+	Fingerprint string
+	// whether the contents differ from those of the snapshot before
+	Changed bool
+}
+
 type PageData struct {
 	URL         string
 	Title       string
@@ -13,6 +41,133 @@ type PageData struct {
 	Lang        string
 	AboutSource string
 	Depth       int
+	Modified    string
+	FirstSeen   string
+	// the date of the last ingest in which the page's contents differed from the one before, & how often that happened
+	LastChanged string
+	Changes     int
+	Inbound     int
+	// the date since which the page's site could not be reached, if it could not
+	Unreachable string
+	// the hash of the page's archived copy & the date it was fetched, if it was archived
+	ArchiveHash string
+	Archived    string
+	// pages of the webring linking to the page, for pages outside of it
+	LinkedFrom []string
+	// the page's ranking score for the search that found it
+	Score float64
+}
+
+// Link is a link found on a crawled page
+type Link struct {
+	Source string
+	Target string
+	// whether the link points to another member of the webring
+	Webring bool
+	Anchor  string
+}
+
+// Simhash is the simhash of a page's text, along with what decides which of a group of near-duplicate pages
+// represents them
+type Simhash struct {
+	URL     string
+	Domain  string
+	Hash    uint64
+	Inbound int
+}
+
+// Count is a name together with the number of times it occurred, e.g. a term & the pages it was found on
+type Count struct {
+	Name  string
+	Count int
+}
+
+// ExternalPage describes a page outside of the webring, as fetched by the crawler
+type ExternalPage struct {
+	Title string
+	About string
+}
+
+// OutgoingDomain is a domain outside of the webring, with the number of member sites, pages & links linking to it
+type OutgoingDomain struct {
+	Domain string
+	Sites  int
+	Pages  int
+	Links  int
+	// the change in the number of linking sites since the previous crawl, and whether the domain is new since then
+	Trend int
+	New   bool
+}
+
+// LinkStatus is the outcome of checking a link for rot
+type LinkStatus struct {
+	URL string
+	// the http status code, 0 if the link could not be fetched at all
+	Status int
+	// empty for working links, otherwise one of: http <status>, dns, timeout, unreachable, parked, invalid
+	Problem  string
+	FinalURL string
+	Checked  string
+}
+
+// BrokenLink is a link on a page of the webring whose target could not be fetched
+type BrokenLink struct {
+	Domain  string
+	Source  string
+	Target  string
+	Problem string
+	Checked string
+}
+
+// CrawlStats describes how crawling a single site went during one crawl
+type CrawlStats struct {
+	// the date of the crawl, as ingested
+	Run      string
+	Domain   string
+	Requests int
+	Errors   int
+	// the number of errors per status code, e.g. 404:3,0:1, where status 0 stands for network errors
+	ErrorCodes string
+	MedianMS   int
+	Pages      int
+	// the number of urls left uncrawled per reason, e.g. fanout:120,duplicate:4
+	CutOff string
+}
+
+// SiteData describes a member of the webring, as presented in the site directory
+type SiteData struct {
+	Domain string
+	// the site's homepage, or the page closest to it
+	URL   string
+	Title string
+	About string
+	Lang  string
+	Depth int
+	Pages int
+	// the date since which the site could not be reached, if it could not
+	Unreachable string
+	// the tags given to the site in the webring file
+	Tags []string
+}
+
+// Ranking determines how pages are scored. the field weights are applied by the ingester, while depth decay &
+// boosts are applied when searching
+type Ranking struct {
+	Title   int `json:"title"`
+	Heading int `json:"heading"`
+	Path    int `json:"path"`
+	Text    int `json:"text"`
+	// the text of links from other members of the webring, indexed as part of the linked page
+	Anchor int `json:"anchor"`
+	// how much a match on a synonym counts, compared to a match on the query term itself
+	Synonyms float64 `json:"synonyms"`
+	// strict (order by precrawl depth first), exponential, hyperbolic or none
+	DepthDecay     string  `json:"depthDecay"`
+	DepthFactor    float64 `json:"depthFactor"`
+	FreshnessBoost float64 `json:"freshnessBoost"`
+	FreshnessDays  int     `json:"freshnessDays"`
+	InboundBoost   float64 `json:"inboundBoost"`
+	AuthorityBoost float64 `json:"authorityBoost"`
 }
 
 type Config struct {
@@ -24,6 +179,8 @@ type Config struct {
 		WebringSelector string `json:"webringSelector"`
 		Port            int    `json:port`
 		Proxy           string `json:proxy`
+		PublicURL       string `json:"publicURL"`
+		Autocomplete    bool   `json:"autocomplete"`
 	} `json:general`
 	Theme struct {
 		Foreground string `json:"foreground"`
@@ -31,10 +188,16 @@ type Config struct {
 		Links      string `json:"links"`
 	} `json:"theme"`
 	Data struct {
-		Source     string `json:source`
-		Database   string `json:database`
-		Heuristics string `json:heuristics`
-		Wordlist   string `json:wordlist`
+		Source         string `json:source`
+		Database       string `json:database`
+		Heuristics     string `json:heuristics`
+		Wordlist       string `json:wordlist`
+		FoldDiacritics bool   `json:"foldDiacritics"`
+		Synonyms       string `json:"synonyms"`
+		// the number of days the last crawled pages of an unreachable site are kept for
+		GracePeriod int `json:"gracePeriod"`
+		// the directory the crawler stores copies of crawled pages in, if set
+		Archive string `json:"archive"`
 	} `json:data`
 	Crawler struct {
 		Webring        string `json:webring`
@@ -43,5 +206,22 @@ type Config struct {
 		BoringWords    string `json:boringWords`
 		BoringDomains  string `json:boringDomains`
 		PreviewQueries string `json:"previewQueryList"`
+		// services hosting parked domains, links redirecting to which are reported as broken
+		ParkedDomains string `json:"parkedDomains"`
+		// visit the pages outside of the webring that members link to, for their titles & descriptions
+		FetchOutgoing bool `json:"fetchOutgoing"`
+		// the WARC file every request & response of a crawl is written to, if set
+		WARC string `json:"warc"`
+		// query parameters which identify a page, the rest being removed from urls
+		QueryParameters string `json:"queryParameters"`
+		// urls longer than this, and more than this many distinct urls under a single path prefix, are left
+		// uncrawled as likely crawler traps. 0 means no limit
+		MaxURLLength int `json:"maxURLLength"`
+		MaxFanout    int `json:"maxFanout"`
 	} `json:crawler`
+	Ranking Ranking `json:"ranking"`
+	API     struct {
+		// origins allowed to make cross-origin requests to the json api, or * for any origin
+		AllowedOrigins []string `json:"allowedOrigins"`
+	} `json:"api"`
 }
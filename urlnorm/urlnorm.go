@@ -0,0 +1,130 @@
+// Package urlnorm rewrites the many addresses a page can be reached at into a single one, so that the page is
+// crawled & indexed only once.
+package urlnorm
+
+import (
+	"net/url"
+	"strings"
+)
+
+// directory index files, which are served for the directory they are in
+var indexFiles = []string{"index.html", "index.htm", "index.php", "default.htm", "default.html"}
+
+// query parameters used to track where visitors came from, which never change the page itself
+var trackingParameters = []string{
+	"fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid", "yclid", "igshid", "twclid",
+	"mc_cid", "mc_eid", "_hsenc", "_hsmi", "mkt_tok", "ref_src",
+}
+
+// Normalizer rewrites urls to their normal form:
+//
+//   - the scheme & host are lowercased, and default ports & fragments removed
+//   - members of the webring are always addressed by the scheme & host (with or without www) of their webring entry
+//   - directory index files, such as index.html, are removed along with the trailing slash
+//   - query parameters are dropped, unless they are on the allow-list & aren't tracking parameters
+type Normalizer struct {
+	// the scheme & host of each member, keyed by its host without www
+	origins map[string]string
+	allowed map[string]bool
+	// keep every query parameter which isn't a tracking parameter
+	allowAll bool
+}
+
+// New returns a normalizer for the given webring members, keeping the given query parameters. a parameter of "*"
+// keeps all of them, except for the tracking parameters
+func New(members []string, parameters []string) *Normalizer {
+	n := &Normalizer{origins: make(map[string]string), allowed: make(map[string]bool)}
+	for _, member := range members {
+		u, err := url.Parse(strings.TrimSpace(member))
+		if err != nil || u.Host == "" {
+			continue
+		}
+		host := normalHost(u)
+		n.origins[strings.TrimPrefix(host, "www.")] = strings.ToLower(u.Scheme) + "://" + host
+	}
+	for _, parameter := range parameters {
+		parameter = strings.TrimSpace(parameter)
+		if parameter == "*" {
+			n.allowAll = true
+		} else if parameter != "" {
+			n.allowed[strings.ToLower(parameter)] = true
+		}
+	}
+	return n
+}
+
+// Normalize returns the normal form of an absolute http(s) url, or false if it is not one
+func (n *Normalizer) Normalize(rawurl string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", false
+	}
+	host := normalHost(u)
+	origin := scheme + "://" + host
+	if preferred, exists := n.origins[strings.TrimPrefix(host, "www.")]; exists {
+		origin = preferred
+	}
+
+	path := u.EscapedPath()
+	for _, index := range indexFiles {
+		if strings.HasSuffix(strings.ToLower(path), "/"+index) {
+			path = path[:len(path)-len(index)]
+			break
+		}
+	}
+	path = strings.TrimSuffix(path, "/")
+
+	query := n.filterQuery(u.Query())
+	if query != "" {
+		if path == "" {
+			path = "/"
+		}
+		return origin + path + "?" + query, true
+	}
+	return origin + path, true
+}
+
+// filterQuery keeps the allowed query parameters, sorted by name
+func (n *Normalizer) filterQuery(values url.Values) string {
+	if !n.allowAll && len(n.allowed) == 0 {
+		return ""
+	}
+	for name := range values {
+		lower := strings.ToLower(name)
+		if isTracking(lower) || (!n.allowAll && !n.allowed[lower]) {
+			values.Del(name)
+		}
+	}
+	return values.Encode()
+}
+
+func isTracking(parameter string) bool {
+	if strings.HasPrefix(parameter, "utm_") {
+		return true
+	}
+	for _, tracking := range trackingParameters {
+		if parameter == tracking {
+			return true
+		}
+	}
+	return false
+}
+
+// normalHost returns the lowercased host of u, without its port if it is the default one for the scheme
+func normalHost(u *url.URL) string {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if strings.Contains(host, ":") {
+		// an ipv6 address
+		host = "[" + host + "]"
+	}
+	port := u.Port()
+	scheme := strings.ToLower(u.Scheme)
+	if port == "" || (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		return host
+	}
+	return host + ":" + port
+}
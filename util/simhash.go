@@ -0,0 +1,57 @@
+package util
+
+import (
+	"hash/fnv"
+	"strings"
+)
+
+// the number of words in each shingle, the overlapping word sequences a page's text is split into
+const shingleSize = 3
+
+// Simhash accumulates the text of a page into a 64 bit hash, such that pages with mostly the same text get hashes
+// which differ in only a few bits
+type Simhash struct {
+	weights [64]int
+	// the number of shingles added
+	Features int
+}
+
+// Add splits a line of text into shingles and adds each of them to the hash
+func (s *Simhash) Add(text string) {
+	words := strings.Fields(strings.ToLower(Normalize(text)))
+	if len(words) == 0 {
+		return
+	}
+	if len(words) < shingleSize {
+		s.addFeature(strings.Join(words, " "))
+		return
+	}
+	for i := 0; i+shingleSize <= len(words); i++ {
+		s.addFeature(strings.Join(words[i:i+shingleSize], " "))
+	}
+}
+
+func (s *Simhash) addFeature(feature string) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+	for bit := 0; bit < 64; bit++ {
+		if sum&(1<<uint(bit)) != 0 {
+			s.weights[bit]++
+		} else {
+			s.weights[bit]--
+		}
+	}
+	s.Features++
+}
+
+// Sum returns the hash of the text added so far
+func (s *Simhash) Sum() uint64 {
+	var hash uint64
+	for bit := 0; bit < 64; bit++ {
+		if s.weights[bit] > 0 {
+			hash |= 1 << uint(bit)
+		}
+	}
+	return hash
+}
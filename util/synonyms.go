@@ -0,0 +1,69 @@
+package util
+
+import (
+	"strings"
+)
+
+// ReadSynonymGroups reads the synonyms file: one group of interchangeable words or phrases per line, separated by
+// commas (e.g. `zine, fanzine`). lines starting with # are comments
+func ReadSynonymGroups(filepath string) [][]string {
+	var groups [][]string
+	for _, line := range ReadList(filepath, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var group []string
+		for _, synonym := range strings.Split(line, ",") {
+			if synonym = strings.TrimSpace(synonym); len(synonym) > 0 {
+				group = append(group, synonym)
+			}
+		}
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// ReadSynonyms maps each single term in the synonyms file to the query terms of every other entry in its group.
+// the entries are processed like search queries, so that they match what was put into the index
+func ReadSynonyms(filepath string, fold bool) map[string][]string {
+	synonyms := make(map[string][]string)
+	for _, group := range ReadSynonymGroups(filepath) {
+		for i, entry := range group {
+			terms, _ := QueryTerms(strings.Fields(entry), fold)
+			if len(terms) != 1 {
+				continue
+			}
+			for j, other := range group {
+				if i != j {
+					otherTerms, _ := QueryTerms(strings.Fields(other), fold)
+					synonyms[terms[0]] = append(synonyms[terms[0]], otherTerms...)
+				}
+			}
+		}
+	}
+	for term, expanded := range synonyms {
+		synonyms[term] = DeduplicateSlice(expanded)
+	}
+	return synonyms
+}
+
+// ExpandSynonyms returns the synonyms of the given query terms, leaving out any that were already part of the query
+func ExpandSynonyms(terms []string, synonyms map[string][]string) []string {
+	var expanded []string
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		seen[term] = true
+	}
+	for _, term := range terms {
+		for _, synonym := range synonyms[term] {
+			if !seen[synonym] {
+				seen[synonym] = true
+				expanded = append(expanded, synonym)
+			}
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,130 @@
+package util
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// chinese & japanese (and to some extent korean) text isn't separated by whitespace, which means a whole
+// sentence would otherwise end up being indexed as one giant "word" that never matches anything.
+func isCJK(r rune) bool {
+	// the katakana prolonged sound mark & the kanji iteration mark are shared between scripts, so list them explicitly
+	if r == 'ー' || r == '々' {
+		return true
+	}
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// SegmentCJK splits each word into runs of cjk and non-cjk characters. non-cjk runs are kept as-is, while cjk
+// runs are converted into overlapping character bigrams (東京都 => 東京 京都). the same segmentation is applied
+// when ingesting & when searching, so a query matches any page containing its bigrams. when ingesting, unigrams is
+// set to also keep each character on its own, so that a single character query matches too.
+func SegmentCJK(words []string, unigrams bool) []string {
+	var segmented []string
+	for _, word := range words {
+		var run []rune
+		var other strings.Builder
+		flushRun := func() {
+			segmented = append(segmented, bigrams(run)...)
+			if unigrams && len(run) > 1 {
+				for _, r := range run {
+					segmented = append(segmented, string(r))
+				}
+			}
+			run = run[:0]
+		}
+		flushOther := func() {
+			if other.Len() > 0 {
+				segmented = append(segmented, other.String())
+				other.Reset()
+			}
+		}
+		for _, r := range word {
+			if isCJK(r) {
+				flushOther()
+				run = append(run, r)
+			} else {
+				flushRun()
+				other.WriteRune(r)
+			}
+		}
+		flushRun()
+		flushOther()
+	}
+	return segmented
+}
+
+func bigrams(run []rune) []string {
+	switch len(run) {
+	case 0:
+		return nil
+	case 1:
+		return []string{string(run)}
+	}
+	grams := make([]string, 0, len(run)-1)
+	for i := 0; i < len(run)-1; i++ {
+		grams = append(grams, string(run[i:i+2]))
+	}
+	return grams
+}
+
+// Normalize applies unicode compatibility normalization (NFKC) and lowercases the result, so that composed &
+// decomposed forms (and e.g. fullwidth latin letters) of the same word end up as the same term
+func Normalize(s string) string {
+	return strings.ToLower(norm.NFKC.String(s))
+}
+
+// letters which don't decompose into a base letter + combining mark, but which people tend to type without the stroke
+var foldedLetters = map[rune]string{
+	'ø': "o", 'ł': "l", 'đ': "d", 'ħ': "h", 'ı': "i", 'ß': "ss", 'æ': "ae", 'œ': "oe", 'þ': "th",
+}
+
+// FoldDiacritics strips accents from latin, greek & cyrillic letters (café => cafe). combining marks in other
+// scripts carry meaning (e.g. japanese dakuten: か => が) and are left alone
+func FoldDiacritics(s string) string {
+	var b strings.Builder
+	var foldable bool
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			if !foldable {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		foldable = unicode.In(r, unicode.Latin, unicode.Greek, unicode.Cyrillic)
+		if folded, exists := foldedLetters[r]; exists {
+			b.WriteString(folded)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// QueryTerms converts the words of a search query into the terms that were put into the index during ingestion:
+// normalized, segmented & singularized. if fold is set, terms are folded & also returned as foldable, meaning that
+// any accented form of them matches too; terms surrounded by double quotes ("café") only match their exact form
+func QueryTerms(words []string, fold bool) (terms []string, foldable []string) {
+	var quoted bool
+	for _, word := range words {
+		exact := quoted || strings.HasPrefix(word, `"`)
+		if strings.HasPrefix(word, `"`) {
+			quoted = true
+			word = strings.TrimPrefix(word, `"`)
+		}
+		if strings.HasSuffix(word, `"`) {
+			quoted = false
+			word = strings.TrimSuffix(word, `"`)
+		}
+		for _, term := range Inflect(SegmentCJK([]string{Normalize(word)}, false)) {
+			if fold && !exact {
+				term = FoldDiacritics(term)
+				foldable = append(foldable, term)
+			}
+			terms = append(terms, term)
+		}
+	}
+	return terms, foldable
+}
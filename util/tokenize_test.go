@@ -0,0 +1,29 @@
+package util
+
+import "testing"
+
+func TestSingleCharacterQuery(t *testing.T) {
+	indexed := SegmentCJK([]string{"東京都に住む"}, true)
+	for _, query := range []string{"東", "京", "む"} {
+		terms, _ := QueryTerms([]string{query}, false)
+		if len(terms) != 1 || !includes(indexed, terms[0]) {
+			t.Errorf("query %q gave terms %q, which are not among the indexed terms %q", query, terms, indexed)
+		}
+	}
+}
+
+func TestQueryKeepsBigrams(t *testing.T) {
+	terms, _ := QueryTerms([]string{"東京都"}, false)
+	if len(terms) != 2 || terms[0] != "東京" || terms[1] != "京都" {
+		t.Errorf("query 東京都 gave terms %q, expected the bigrams 東京 & 京都", terms)
+	}
+}
+
+func includes(terms []string, term string) bool {
+	for _, t := range terms {
+		if t == term {
+			return true
+		}
+	}
+	return false
+}
@@ -153,14 +153,31 @@ func ReadConfig() types.Config {
 	Check(err)
 
 	var conf types.Config
+	// decoding leaves the fields missing from the config as they are
+	conf.Ranking = defaultRanking()
 	decoder := json.NewDecoder(toml.New(bytes.NewBuffer(data)))
 
 	err = decoder.Decode(&conf)
 	Check(err)
-
 	return conf
 }
 
+// the ranking used for whatever the [ranking] section of the config leaves out: lieu's original scoring. a weight
+// which is set, even to 0, is kept as it is
+func defaultRanking() types.Ranking {
+	return types.Ranking{
+		Title:         5,
+		Heading:       15,
+		Path:          2,
+		Text:          1,
+		Anchor:        3,
+		Synonyms:      0.5,
+		DepthDecay:    "strict",
+		DepthFactor:   0.5,
+		FreshnessDays: 365,
+	}
+}
+
 func WriteMockConfig() {
 	conf := []byte(`[general]
 name = "Sweet Webring"
@@ -168,6 +185,11 @@ name = "Sweet Webring"
 url = "https://example.com/"
 webringSelector = "li > a"
 port = 10001
+# the address this instance is reachable at, used by browsers adding it as a search engine (opensearch).
+# if left out, the address of the incoming request is used
+# publicURL = "https://search.example.com"
+# suggest search terms & page titles while typing in the search box
+autocomplete = true
 
 [theme]
 # colors specified in hex (or valid css names) which determine the theme of the lieu instance
@@ -184,6 +206,15 @@ database = "data/searchengine.db"
 heuristics = "data/heuristics.txt"
 # aka stopwords, in the search engine biz: https://en.wikipedia.org/wiki/Stop_word
 wordlist = "data/wordlist.txt"
+# ignore accents when searching, so that "cafe" finds "café" & vice versa. wrap a query term in
+# double quotes to only match its exact form
+foldDiacritics = true
+# groups of interchangeable words, one comma-separated group per line (e.g. zine, fanzine), used to expand queries
+synonyms = "data/synonyms.txt"
+# keep the last crawled pages of a site that can't be reached for this many days, marked as unreachable (0 to drop them)
+gracePeriod = 30
+# keep compressed copies of crawled pages in this directory, linked to as "cached" from search results (leave out to disable)
+archive = "data/archive"
 
 [crawler]
 # manually curated list of domains, or the output of the precrawl command
@@ -198,6 +229,45 @@ boringWords = "data/boring-words.txt"
 boringDomains = "data/boring-domains.txt"
 # queries to search for finding preview text
 previewQueryList = "data/preview-query-list.txt"
+# visit the pages outside of the webring that members link to, once, for their titles & descriptions
+fetchOutgoing = false
+# services hosting parked domains: links redirecting to them are reported by lieu linkrot
+parkedDomains = "data/parked-domains.txt"
+# write every request & response of a crawl to this WARC file (.warc or .warc.gz), for replaying it with lieu ingest
+warc = ""
+# query parameters that identify a page (e.g. ?page=2), one per line; all others are removed from crawled urls
+queryParameters = "data/query-parameters.txt"
+# leave urls longer than maxURLLength, and more than maxFanout distinct urls under a single path, uncrawled as
+# likely crawler traps (calendars, tag combinations, session urls). 0 means no limit
+maxURLLength = 300
+maxFanout = 1000
+
+[ranking]
+# how much a search term counts depending on where on a page it was found. applied by lieu ingest
+title = 5
+heading = 15
+path = 2
+text = 1
+# the text of links from other members of the webring, counted towards the linked page
+anchor = 3
+# how much a match on a synonym counts, compared to a match on the searched term itself
+synonyms = 0.5
+# how a site's precrawl depth affects its pages' scores: strict (always list lower depths first, lieu's
+# original ordering), or else exponential (score * depthFactor^depth), hyperbolic (score / (1 + depthFactor * depth))
+# or none, which mix pages of different depths
+depthDecay = "strict"
+depthFactor = 0.5
+# boost pages modified within the last freshnessDays days by up to freshnessBoost (0.5 = +50%), e.g. 0.25
+freshnessBoost = 0
+freshnessDays = 365
+# boost pages linked to by other members of the webring by up to inboundBoost, e.g. 0.5
+inboundBoost = 0
+# boost pages by up to authorityBoost according to their pagerank within the webring's link graph, e.g. 0.5
+authorityBoost = 0
+
+[api]
+# sites allowed to query the json api (/api/search) from the browser, e.g. ["https://example.com"], or ["*"] for all
+allowedOrigins = ["*"]
 `)
 	err := ioutil.WriteFile("lieu.toml", conf, 0644)
 	Check(err)
@@ -0,0 +1,232 @@
+package warc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Record is a single record of a WARC file
+type Record struct {
+	Header textproto.MIMEHeader
+	Block  []byte
+}
+
+// Type returns the kind of record, e.g. warcinfo, request or response
+func (r *Record) Type() string {
+	return r.Header.Get("WARC-Type")
+}
+
+// TargetURI returns the url the record was captured from
+func (r *Record) TargetURI() string {
+	// some tools wrap the uri in angle brackets, as in earlier versions of the spec
+	return strings.Trim(r.Header.Get("WARC-Target-URI"), "<>")
+}
+
+// the largest record read into memory. larger ones, such as videos in third-party archives, are skipped
+const maxRecordSize = 64 << 20
+
+var errRecordTooLarge = errors.New("warc: record larger than 64 MiB")
+
+// readRecord reads the next record, returning io.EOF if there are none left
+func readRecord(br *bufio.Reader) (*Record, error) {
+	// skip the blank lines which separate records
+	var line string
+	for line == "" {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && strings.TrimSpace(l) == "" {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		line = strings.TrimSpace(l)
+	}
+	if !strings.HasPrefix(line, "WARC/") {
+		return nil, errors.New("warc: expected a record, found " + strconv.Quote(line))
+	}
+
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, errors.New("warc: record without a valid Content-Length")
+	}
+	if length > maxRecordSize {
+		// skip over the block, so that the records after it can still be read
+		if _, err = io.CopyN(ioutil.Discard, br, length); err != nil {
+			return nil, err
+		}
+		return nil, errRecordTooLarge
+	}
+	block := make([]byte, length)
+	if _, err = io.ReadFull(br, block); err != nil {
+		return nil, err
+	}
+	return &Record{Header: header, Block: block}, nil
+}
+
+// countingReader keeps track of how many bytes were read from the underlying reader. as it is an io.ByteReader, the
+// gzip decompressor reads no further than the end of the current member
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func isGzip(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// location is where a record can be found: the offset of the gzip member (or of the record itself, in uncompressed
+// files) and how many records precede it within that member
+type location struct {
+	path   string
+	offset int64
+	skip   int
+}
+
+// Index maps urls to the responses captured from them, across one or more WARC files
+type Index struct {
+	responses map[string]location
+	urls      []string
+}
+
+// NewIndex reads through the given WARC files, compressed or not, and notes where the response to each url is stored.
+// when a url was captured more than once, the last response wins
+func NewIndex(paths []string) (*Index, error) {
+	index := &Index{responses: make(map[string]location)}
+	for _, path := range paths {
+		if err := index.add(path); err != nil {
+			return nil, errors.New(path + ": " + err.Error())
+		}
+	}
+	return index, nil
+}
+
+func (index *Index) add(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	cr := &countingReader{r: bufio.NewReader(file)}
+
+	note := func(record *Record, loc location) {
+		if record.Type() != "response" || record.TargetURI() == "" {
+			return
+		}
+		uri := record.TargetURI()
+		if _, exists := index.responses[uri]; !exists {
+			index.urls = append(index.urls, uri)
+		}
+		index.responses[uri] = loc
+	}
+
+	if !isGzip(cr.r) {
+		br := bufio.NewReader(cr)
+		for {
+			offset := cr.n - int64(br.Buffered())
+			record, err := readRecord(br)
+			if err == io.EOF {
+				return nil
+			} else if err == errRecordTooLarge {
+				continue
+			} else if err != nil {
+				return err
+			}
+			note(record, location{path: path, offset: offset})
+		}
+	}
+
+	var zr *gzip.Reader
+	for {
+		if _, err := cr.r.Peek(1); err == io.EOF {
+			return nil
+		}
+		offset := cr.n
+		var err error
+		if zr == nil {
+			zr, err = gzip.NewReader(cr)
+		} else {
+			err = zr.Reset(cr)
+		}
+		if err != nil {
+			return err
+		}
+		zr.Multistream(false)
+		// each member usually holds a single record, though some tools compress the whole file as one
+		br := bufio.NewReader(zr)
+		for skip := 0; ; skip++ {
+			record, err := readRecord(br)
+			if err == io.EOF {
+				break
+			} else if err == errRecordTooLarge {
+				continue
+			} else if err != nil {
+				return err
+			}
+			note(record, location{path: path, offset: offset, skip: skip})
+		}
+	}
+}
+
+// URLs returns the urls with a captured response, in the order they were first found
+func (index *Index) URLs() []string {
+	return index.urls
+}
+
+// Lookup returns the captured response to the url, if there is one. the record's block is the http response,
+// including its status line & headers
+func (index *Index) Lookup(uri string) (*Record, error) {
+	loc, exists := index.responses[uri]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	file, err := os.Open(loc.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(loc.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(file)
+	if isGzip(br) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		br = bufio.NewReader(zr)
+	}
+	for i := 0; i < loc.skip; i++ {
+		if _, err = readRecord(br); err != nil && err != errRecordTooLarge {
+			return nil, err
+		}
+	}
+	return readRecord(br)
+}
@@ -0,0 +1,102 @@
+// Package warc reads & writes files in the Web ARChive format (ISO 28500), which is what web archiving tools such
+// as wget, heritrix & the wayback machine store their crawls in.
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const version = "WARC/1.1"
+
+// Writer appends records to a WARC file. it is safe for concurrent use
+type Writer struct {
+	mutex    sync.Mutex
+	file     *os.File
+	compress bool
+}
+
+// Create creates the WARC file at path, replacing any existing file. files with a .gz extension get each of their
+// records compressed separately, as is the convention, so that a record can be read without reading those before it
+func Create(path string) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: file, compress: strings.HasSuffix(path, ".gz")}, nil
+}
+
+// WriteRecord appends a record of the given type to the file and returns its id. the extra header fields are given
+// as name, value pairs
+func (w *Writer) WriteRecord(kind, uri, contentType string, block []byte, extra ...string) (string, error) {
+	id, err := newRecordID()
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(version + "\r\n")
+	field := func(name, value string) {
+		b.WriteString(name + ": " + value + "\r\n")
+	}
+	field("WARC-Type", kind)
+	field("WARC-Record-ID", id)
+	field("WARC-Date", time.Now().UTC().Format(time.RFC3339))
+	if uri != "" {
+		field("WARC-Target-URI", uri)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		field(extra[i], extra[i+1])
+	}
+	field("WARC-Block-Digest", Digest(block))
+	field("Content-Type", contentType)
+	field("Content-Length", strconv.Itoa(len(block)))
+	b.WriteString("\r\n")
+	b.Write(block)
+	b.WriteString("\r\n\r\n")
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.compress {
+		_, err = w.file.Write(b.Bytes())
+		return id, err
+	}
+	zw := gzip.NewWriter(w.file)
+	if _, err = zw.Write(b.Bytes()); err != nil {
+		return "", err
+	}
+	return id, zw.Close()
+}
+
+// Close closes the underlying file
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
+}
+
+// Digest returns the digest of data in the form used by the WARC-Block-Digest & WARC-Payload-Digest fields
+func Digest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// newRecordID returns a random (version 4) uuid in the form of a WARC record id
+func newRecordID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}